@@ -17,8 +17,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"math"
+	"reflect"
 	"strconv"
 
+	"github.com/prometheus/prometheus/pkg/histogram"
 	"github.com/prometheus/prometheus/pkg/labels"
 )
 
@@ -28,6 +30,12 @@ type Exemplar struct {
 	Value  float64       `json:"value"`
 	Ts     int64         `json:"timestamp"`
 	HasTs  bool          `json:"-"`
+
+	// HistogramValue is set instead of Value for an exemplar attached to a
+	// native (sparse) histogram sample, carrying the full bucket layout the
+	// exemplar was recorded against rather than a single scalar. Nil for
+	// exemplars attached to classic samples.
+	HistogramValue *histogram.SparseHistogram `json:"histogram,omitempty"`
 }
 
 // Equals compares if the exemplar e is the same as e2.
@@ -44,6 +52,13 @@ func (e Exemplar) Equals(e2 Exemplar) bool {
 		return false
 	}
 
+	if (e.HistogramValue == nil) != (e2.HistogramValue == nil) {
+		return false
+	}
+	if e.HistogramValue != nil && !reflect.DeepEqual(*e.HistogramValue, *e2.HistogramValue) {
+		return false
+	}
+
 	return true
 }
 
@@ -70,25 +85,34 @@ func (e Exemplar) MarshalJSON() ([]byte, error) {
 		return nil, err
 	}
 
-	abs := math.Abs(e.Value)
-	fmt := byte('f')
-	// Note: Must use float32 comparisons for underlying float32 value to get precise cutoffs right.
-	if abs != 0 {
-		if abs < 1e-6 || abs >= 1e21 {
-			fmt = 'e'
+	var value string
+	if e.HistogramValue == nil {
+		abs := math.Abs(e.Value)
+		fmt := byte('f')
+		// Note: Must use float32 comparisons for underlying float32 value to get precise cutoffs right.
+		if abs != 0 {
+			if abs < 1e-6 || abs >= 1e21 {
+				fmt = 'e'
+			}
 		}
+		nts.Reset()
+		b := nts.Bytes()
+		b = strconv.AppendFloat(b, e.Value, fmt, -1, 64)
+		value = string(b)
 	}
-	nts.Reset()
-	b := nts.Bytes()
-	b = strconv.AppendFloat(b, e.Value, fmt, -1, 64)
 
+	// A histogram exemplar carries its value in Histogram instead of Value
+	// (omitted entirely for that case), so /api/v1/query_exemplars can
+	// distinguish the two on the wire rather than serving a meaningless "0".
 	return json.Marshal(&struct {
-		Labels labels.Labels `json:"labels"`
-		Value  string        `json:"value"`
-		Ts     float64       `json:"timestamp"`
+		Labels    labels.Labels              `json:"labels"`
+		Value     string                     `json:"value,omitempty"`
+		Histogram *histogram.SparseHistogram `json:"histogram,omitempty"`
+		Ts        float64                    `json:"timestamp"`
 	}{
-		Labels: e.Labels,
-		Value:  string(b),
-		Ts:     f,
+		Labels:    e.Labels,
+		Value:     value,
+		Histogram: e.HistogramValue,
+		Ts:        f,
 	})
 }
@@ -0,0 +1,487 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package histogram contains the in-memory representation of the sparse,
+// exponential-bucket histograms used by native histogram ingestion and the
+// conversion routines between that representation and classic, cumulative
+// buckets.
+package histogram
+
+import (
+	"math"
+	"sync"
+)
+
+// Span describes a group of consecutive buckets within a SparseHistogram. The
+// first Span in a list of spans carries an absolute Offset; every following
+// Span's Offset is the number of empty buckets between the end of the
+// previous Span and the start of this one (i.e. a gap, not an absolute
+// index).
+type Span struct {
+	Offset int32
+	Length uint32
+}
+
+// SparseHistogram is the in-memory representation of a native histogram with
+// exponential bucket boundaries determined by Schema. Buckets are stored
+// sparsely: PositiveSpans/NegativeSpans describe which bucket indices are
+// populated, and PositiveBuckets/NegativeBuckets hold the bucket counts,
+// delta-encoded against the previous populated bucket in the same list.
+type SparseHistogram struct {
+	Schema        int32
+	ZeroThreshold float64
+	ZeroCount     uint64
+	Count         uint64
+	Sum           float64
+
+	PositiveSpans   []Span
+	PositiveBuckets []int64
+	NegativeSpans   []Span
+	NegativeBuckets []int64
+}
+
+// Bucket is a single cumulative classic bucket, compatible with the bucket
+// representation used for classic histograms: Count is the number of
+// observations less than or equal to Le.
+type Bucket struct {
+	Count int64
+	Le    float64
+}
+
+// getBound returns the upper boundary of bucket index idx in the given
+// schema. The base of the exponential series is 2^(2^-schema).
+//
+// For schema <= 0, 2^-schema is itself an integer, so the bound 2^(idx *
+// 2^-schema) is computed with an exact integer left-shift plus
+// math.Ldexp, with no fractional exponentiation (and therefore no
+// floating-point error) involved at all.
+//
+// For schema > 0, idx is split into an integer power-of-two part (exp) and
+// a fractional part within [0, 2^schema); the fractional part indexes into
+// a per-schema table of precomputed bounds (see fracBounds) rather than
+// calling math.Pow on every lookup, and the power-of-two part is folded in
+// exactly via math.Ldexp.
+func getBound(idx int32, schema int32) float64 {
+	if schema <= 0 {
+		return math.Ldexp(1, int(idx)<<uint(-schema))
+	}
+	n := int32(1) << uint(schema)
+	frac := idx % n
+	exp := idx / n
+	if frac < 0 {
+		frac += n
+		exp--
+	}
+	return math.Ldexp(fracBounds(schema)[frac], int(exp))
+}
+
+var (
+	fracBoundsMu    sync.Mutex
+	fracBoundsCache = map[int32][]float64{}
+)
+
+// fracBounds returns, for a positive schema, the bound base^i for every i in
+// [0, 2^schema), where base is 2^(2^-schema). The table is computed once per
+// schema and cached, since in practice only a handful of distinct schemas
+// are ever in use at a time.
+func fracBounds(schema int32) []float64 {
+	fracBoundsMu.Lock()
+	defer fracBoundsMu.Unlock()
+	if bounds, ok := fracBoundsCache[schema]; ok {
+		return bounds
+	}
+	n := int32(1) << uint(schema)
+	base := math.Pow(2, 1/float64(n))
+	bounds := make([]float64, n)
+	for i := range bounds {
+		bounds[i] = math.Pow(base, float64(i))
+	}
+	fracBoundsCache[schema] = bounds
+	return bounds
+}
+
+// BucketIterator lets a SparseHistogram be iterated as a series of
+// cumulative classic buckets, one per populated index and one for every gap
+// in between (so that the result is continuous and directly comparable to a
+// classic histogram's buckets).
+type BucketIterator struct {
+	buckets []Bucket
+	pos     int
+	err     error
+}
+
+// CumulativeExpandSparseHistogram returns a BucketIterator over h, in
+// increasing Le order: the negative buckets (Le is the negative-side upper
+// boundary, so least negative last), then the zero bucket (Le equal to
+// +ZeroThreshold, if ZeroThreshold is set), then the positive buckets. The
+// count of each bucket is cumulative over everything at or below it,
+// including the negative/zero regions.
+func CumulativeExpandSparseHistogram(h SparseHistogram) *BucketIterator {
+	all := expandNegativeBuckets(h.Schema, h.NegativeSpans, h.NegativeBuckets)
+
+	var offset int64
+	if len(all) > 0 {
+		offset = all[len(all)-1].Count
+	}
+
+	if h.ZeroThreshold > 0 {
+		offset += int64(h.ZeroCount)
+		all = append(all, Bucket{Le: h.ZeroThreshold, Count: offset})
+	}
+
+	for _, b := range expandPositiveBuckets(h.Schema, h.PositiveSpans, h.PositiveBuckets) {
+		all = append(all, Bucket{Le: b.Le, Count: b.Count + offset})
+	}
+
+	return &BucketIterator{buckets: all}
+}
+
+// Next advances the iterator and reports whether a bucket is available.
+func (b *BucketIterator) Next() bool {
+	if b.pos >= len(b.buckets) {
+		return false
+	}
+	b.pos++
+	return true
+}
+
+// At returns the current bucket. It must only be called after a call to
+// Next that returned true.
+func (b *BucketIterator) At() Bucket {
+	return b.buckets[b.pos-1]
+}
+
+// Err returns the last error, if any.
+func (b *BucketIterator) Err() error {
+	return b.err
+}
+
+// expandPositiveBuckets walks spans/buckets in increasing index order,
+// emitting one Bucket per index from the first populated one to the last,
+// including the gaps in between (whose count is carried over unchanged from
+// the previous index).
+func expandPositiveBuckets(schema int32, spans []Span, buckets []int64) []Bucket {
+	if len(spans) == 0 {
+		return nil
+	}
+	result := make([]Bucket, 0, len(buckets))
+
+	spanIdx := 0
+	spanRemaining := spans[0].Length - 1
+	inSpan := true
+	var pendingStart int32
+	curIdx := spans[0].Offset
+	lastCount := buckets[0]
+	cum := lastCount
+	nextBucket := 1
+
+	result = append(result, Bucket{Le: getBound(curIdx, schema), Count: cum})
+
+	for {
+		if inSpan && spanRemaining > 0 {
+			curIdx++
+			spanRemaining--
+			lastCount += buckets[nextBucket]
+			nextBucket++
+			cum += lastCount
+			result = append(result, Bucket{Le: getBound(curIdx, schema), Count: cum})
+			continue
+		}
+
+		if inSpan {
+			// We just emitted the last bucket of the current span. Move on
+			// to the next one, if there is one.
+			inSpan = false
+			spanIdx++
+			if spanIdx >= len(spans) {
+				break
+			}
+			pendingStart = curIdx + spans[spanIdx].Offset + 1
+		}
+
+		curIdx++
+		if curIdx < pendingStart {
+			// Empty bucket between spans: the cumulative count doesn't change.
+			result = append(result, Bucket{Le: getBound(curIdx, schema), Count: cum})
+			continue
+		}
+
+		inSpan = true
+		spanRemaining = spans[spanIdx].Length - 1
+		lastCount += buckets[nextBucket]
+		nextBucket++
+		cum += lastCount
+		result = append(result, Bucket{Le: getBound(curIdx, schema), Count: cum})
+	}
+
+	return result
+}
+
+// expandNegativeBuckets is the mirror of expandPositiveBuckets for the
+// negative side: it walks the populated indices from the most extreme
+// (largest magnitude) to the least, so that Le - the negative of the lower
+// boundary of the mirrored positive bucket, i.e. the negative bucket's upper
+// boundary, nearest zero - comes out in increasing order, ending closest to
+// zero.
+func expandNegativeBuckets(schema int32, spans []Span, buckets []int64) []Bucket {
+	idxs, counts := explicitBuckets(spans, buckets)
+	if len(idxs) == 0 {
+		return nil
+	}
+
+	result := make([]Bucket, 0, len(idxs))
+	var cum int64
+	i := len(idxs) - 1
+	for idx := idxs[i]; ; idx-- {
+		if i >= 0 && idxs[i] == idx {
+			cum += counts[i]
+			i--
+		}
+		result = append(result, Bucket{Le: -getBound(idx-1, schema), Count: cum})
+		if idx == idxs[0] {
+			break
+		}
+	}
+	return result
+}
+
+// explicitBuckets decodes spans/buckets into the absolute index and the
+// (non-cumulative) count of every populated bucket, in increasing index
+// order. Gaps between spans are omitted since their count is implicitly 0.
+func explicitBuckets(spans []Span, buckets []int64) (idxs []int32, counts []int64) {
+	if len(spans) == 0 {
+		return nil, nil
+	}
+	idxs = make([]int32, 0, len(buckets))
+	counts = make([]int64, 0, len(buckets))
+
+	var idx int32
+	var count int64
+	bi := 0
+	for si, s := range spans {
+		if si == 0 {
+			idx = s.Offset
+		} else {
+			idx += s.Offset
+		}
+		for j := uint32(0); j < s.Length; j++ {
+			if bi == 0 {
+				count = buckets[bi]
+			} else {
+				count += buckets[bi]
+			}
+			idxs = append(idxs, idx)
+			counts = append(counts, count)
+			bi++
+			idx++
+		}
+	}
+	return idxs, counts
+}
+
+// buildSpans is the inverse of explicitBuckets: given the absolute index and
+// count of every populated bucket (strictly increasing idxs, as produced by
+// explicitBuckets or a merge thereof), it re-encodes them as spans plus
+// delta-encoded bucket counts.
+func buildSpans(idxs []int32, counts []int64) ([]Span, []int64) {
+	if len(idxs) == 0 {
+		return nil, nil
+	}
+	spans := make([]Span, 0, 1)
+	buckets := make([]int64, 0, len(counts))
+
+	var prevIdx int32
+	var prevCount int64
+	for i, idx := range idxs {
+		switch {
+		case i == 0:
+			spans = append(spans, Span{Offset: idx, Length: 1})
+			buckets = append(buckets, counts[i])
+		case idx == prevIdx+1:
+			spans[len(spans)-1].Length++
+			buckets = append(buckets, counts[i]-prevCount)
+		default:
+			spans = append(spans, Span{Offset: idx - prevIdx - 1, Length: 1})
+			buckets = append(buckets, counts[i]-prevCount)
+		}
+		prevIdx, prevCount = idx, counts[i]
+	}
+	return spans, buckets
+}
+
+// Rescale returns h converted to targetSchema, merging adjacent buckets as
+// needed. targetSchema must be <= h.Schema; if it is equal, h is returned
+// unchanged. ZeroCount, ZeroThreshold, Count and Sum are unaffected, since
+// rescaling only changes how the non-zero buckets are grouped.
+func (h SparseHistogram) Rescale(targetSchema int32) SparseHistogram {
+	if targetSchema >= h.Schema {
+		return h
+	}
+	shift := uint(h.Schema - targetSchema)
+	positiveSpans, positiveBuckets := RescaleBuckets(h.PositiveSpans, h.PositiveBuckets, shift)
+	negativeSpans, negativeBuckets := RescaleBuckets(h.NegativeSpans, h.NegativeBuckets, shift)
+	return SparseHistogram{
+		Schema:          targetSchema,
+		ZeroThreshold:   h.ZeroThreshold,
+		ZeroCount:       h.ZeroCount,
+		Count:           h.Count,
+		Sum:             h.Sum,
+		PositiveSpans:   positiveSpans,
+		PositiveBuckets: positiveBuckets,
+		NegativeSpans:   negativeSpans,
+		NegativeBuckets: negativeBuckets,
+	}
+}
+
+// Add returns the sum of h and other, aligning schema and ZeroThreshold
+// first if they differ. It is the core primitive behind aggregating or
+// rate()-ing native histograms.
+func (h SparseHistogram) Add(other SparseHistogram) (SparseHistogram, error) {
+	return h.combine(other, 1)
+}
+
+// Sub returns h minus other, aligning schema and ZeroThreshold first if they
+// differ. See Add.
+func (h SparseHistogram) Sub(other SparseHistogram) (SparseHistogram, error) {
+	return h.combine(other, -1)
+}
+
+func (h SparseHistogram) combine(other SparseHistogram, sign int64) (SparseHistogram, error) {
+	schema := h.Schema
+	if other.Schema < schema {
+		schema = other.Schema
+	}
+	a := h.Rescale(schema)
+	b := other.Rescale(schema)
+
+	threshold := a.ZeroThreshold
+	if b.ZeroThreshold > threshold {
+		threshold = b.ZeroThreshold
+	}
+
+	aPosSpans, aPosBuckets, aPosFolded := foldIntoZero(schema, a.PositiveSpans, a.PositiveBuckets, threshold)
+	aNegSpans, aNegBuckets, aNegFolded := foldIntoZero(schema, a.NegativeSpans, a.NegativeBuckets, threshold)
+	bPosSpans, bPosBuckets, bPosFolded := foldIntoZero(schema, b.PositiveSpans, b.PositiveBuckets, threshold)
+	bNegSpans, bNegBuckets, bNegFolded := foldIntoZero(schema, b.NegativeSpans, b.NegativeBuckets, threshold)
+
+	positiveSpans, positiveBuckets := mergeBuckets(aPosSpans, aPosBuckets, bPosSpans, bPosBuckets, sign)
+	negativeSpans, negativeBuckets := mergeBuckets(aNegSpans, aNegBuckets, bNegSpans, bNegBuckets, sign)
+
+	zeroCount := int64(a.ZeroCount) + int64(aPosFolded) + int64(aNegFolded) +
+		sign*(int64(b.ZeroCount)+int64(bPosFolded)+int64(bNegFolded))
+	count := int64(a.Count) + sign*int64(b.Count)
+
+	return SparseHistogram{
+		Schema:          schema,
+		ZeroThreshold:   threshold,
+		ZeroCount:       uint64(zeroCount),
+		Count:           uint64(count),
+		Sum:             a.Sum + float64(sign)*b.Sum,
+		PositiveSpans:   positiveSpans,
+		PositiveBuckets: positiveBuckets,
+		NegativeSpans:   negativeSpans,
+		NegativeBuckets: negativeBuckets,
+	}, nil
+}
+
+// foldIntoZero drops every populated bucket whose upper boundary falls at or
+// below threshold (i.e. it lies entirely within the combined zero bucket)
+// and reports the total count folded away, so the caller can add it to
+// ZeroCount.
+func foldIntoZero(schema int32, spans []Span, buckets []int64, threshold float64) ([]Span, []int64, uint64) {
+	idxs, counts := explicitBuckets(spans, buckets)
+	if len(idxs) == 0 {
+		return nil, nil, 0
+	}
+
+	keptIdxs := make([]int32, 0, len(idxs))
+	keptCounts := make([]int64, 0, len(counts))
+	var folded uint64
+	for i, idx := range idxs {
+		if getBound(idx, schema) <= threshold {
+			folded += uint64(counts[i])
+			continue
+		}
+		keptIdxs = append(keptIdxs, idx)
+		keptCounts = append(keptCounts, counts[i])
+	}
+	newSpans, newBuckets := buildSpans(keptIdxs, keptCounts)
+	return newSpans, newBuckets, folded
+}
+
+// mergeBuckets walks two populated-bucket streams (already aligned to the
+// same schema) in absolute-index order, adding (or, if sign is -1,
+// subtracting) counts that share an index, and re-emits the result as spans
+// plus delta-encoded buckets. Indices whose combined count is zero are
+// dropped.
+func mergeBuckets(aSpans []Span, aBuckets []int64, bSpans []Span, bBuckets []int64, sign int64) ([]Span, []int64) {
+	aIdx, aCount := explicitBuckets(aSpans, aBuckets)
+	bIdx, bCount := explicitBuckets(bSpans, bBuckets)
+
+	idxs := make([]int32, 0, len(aIdx)+len(bIdx))
+	counts := make([]int64, 0, len(aIdx)+len(bIdx))
+
+	i, j := 0, 0
+	for i < len(aIdx) || j < len(bIdx) {
+		var idx int32
+		var val int64
+		switch {
+		case j >= len(bIdx) || (i < len(aIdx) && aIdx[i] < bIdx[j]):
+			idx, val = aIdx[i], aCount[i]
+			i++
+		case i >= len(aIdx) || bIdx[j] < aIdx[i]:
+			idx, val = bIdx[j], sign*bCount[j]
+			j++
+		default:
+			idx, val = aIdx[i], aCount[i]+sign*bCount[j]
+			i++
+			j++
+		}
+		if val == 0 {
+			continue
+		}
+		idxs = append(idxs, idx)
+		counts = append(counts, val)
+	}
+	return buildSpans(idxs, counts)
+}
+
+// RescaleBuckets is the span/bucket-level mirror of Rescale: it merges the
+// buckets described by spans/buckets down by shift schema steps, i.e. every
+// 2^shift consecutive source indices collapse into one target index. It
+// operates independently on whichever one of PositiveSpans/NegativeSpans (and
+// their matching buckets) is passed in, so callers rescale the positive and
+// negative arms of a histogram the same way.
+//
+// The target index for source index i is i>>shift, an arithmetic (sign
+// extending) shift, so that it rounds toward -Inf rather than toward zero;
+// plain integer division would misbucket negative indices.
+func RescaleBuckets(spans []Span, buckets []int64, shift uint) ([]Span, []int64) {
+	idxs, counts := explicitBuckets(spans, buckets)
+	if len(idxs) == 0 {
+		return nil, nil
+	}
+
+	mergedIdxs := make([]int32, 0, len(idxs))
+	mergedCounts := make([]int64, 0, len(counts))
+	for i, idx := range idxs {
+		target := idx >> shift
+		if n := len(mergedIdxs); n > 0 && mergedIdxs[n-1] == target {
+			mergedCounts[n-1] += counts[i]
+			continue
+		}
+		mergedIdxs = append(mergedIdxs, target)
+		mergedCounts = append(mergedCounts, counts[i])
+	}
+	return buildSpans(mergedIdxs, mergedCounts)
+}
@@ -97,28 +97,112 @@ func TestCumulativeExpandSparseHistogram(t *testing.T) {
 				{Le: 1.5422108254079407, Count: 13}, // 4
 			},
 		},
-		//{
-		//	hist: SparseHistogram{
-		//		Schema: -2,
-		//		PositiveSpans: []Span{
-		//			{Offset: -2, Length: 4}, // -2 -1 0 1
-		//			{Offset: 2, Length: 2},  // 4 5
-		//		},
-		//		PositiveBuckets: []int64{1, 2, -2, 1, -1, 0},
-		//	},
-		//	expBuckets: []Bucket{
-		//		{Le: 0.00390625, Count: 1}, // -2
-		//		{Le: 0.0625, Count: 4},     // -1
-		//		{Le: 1, Count: 5},          // 0
-		//		{Le: 16, Count: 7},         // 1
-		//
-		//		{Le: 256, Count: 7},  // 2
-		//		{Le: 4096, Count: 7}, // 3
-		//
-		//		{Le: 65539, Count: 8},   // 4
-		//		{Le: 1048576, Count: 9}, // 5
-		//	},
-		//},
+		{
+			hist: SparseHistogram{
+				Schema: 0,
+				NegativeSpans: []Span{
+					{Offset: 0, Length: 2},
+					{Offset: 1, Length: 2},
+				},
+				NegativeBuckets: []int64{1, 1, -1, 0},
+			},
+			expBuckets: []Bucket{
+				{Le: -8, Count: 1},
+				{Le: -4, Count: 2},
+
+				{Le: -2, Count: 2},
+
+				{Le: -1, Count: 4},
+				{Le: -0.5, Count: 5},
+			},
+		},
+		{
+			hist: SparseHistogram{
+				Schema:        0,
+				ZeroThreshold: 0.5,
+				ZeroCount:     2,
+				NegativeSpans: []Span{
+					{Offset: 0, Length: 2},
+					{Offset: 1, Length: 2},
+				},
+				NegativeBuckets: []int64{1, 1, -1, 0},
+				PositiveSpans: []Span{
+					{Offset: 0, Length: 2},
+					{Offset: 1, Length: 2},
+				},
+				PositiveBuckets: []int64{1, 1, -1, 0},
+			},
+			expBuckets: []Bucket{
+				{Le: -8, Count: 1},
+				{Le: -4, Count: 2},
+
+				{Le: -2, Count: 2},
+
+				{Le: -1, Count: 4},
+				{Le: -0.5, Count: 5},
+
+				{Le: 0.5, Count: 7},
+
+				{Le: 1, Count: 8},
+				{Le: 2, Count: 10},
+
+				{Le: 4, Count: 10},
+
+				{Le: 8, Count: 11},
+				{Le: 16, Count: 12},
+			},
+		},
+		{
+			hist: SparseHistogram{
+				Schema: -2,
+				PositiveSpans: []Span{
+					{Offset: -2, Length: 4}, // -2 -1 0 1
+					{Offset: 2, Length: 2},  // 4 5
+				},
+				PositiveBuckets: []int64{1, 2, -2, 1, -1, 0},
+			},
+			expBuckets: []Bucket{
+				{Le: 0.00390625, Count: 1}, // -2
+				{Le: 0.0625, Count: 4},     // -1
+				{Le: 1, Count: 5},          // 0
+				{Le: 16, Count: 7},         // 1
+
+				{Le: 256, Count: 7},  // 2
+				{Le: 4096, Count: 7}, // 3
+
+				{Le: 65536, Count: 8},   // 4
+				{Le: 1048576, Count: 9}, // 5
+			},
+		},
+		{
+			hist: SparseHistogram{
+				Schema: -1,
+				PositiveSpans: []Span{
+					{Offset: -1, Length: 4}, // -1 0 1 2
+				},
+				PositiveBuckets: []int64{1, 2, -2, 1},
+			},
+			expBuckets: []Bucket{
+				{Le: 0.25, Count: 1}, // -1
+				{Le: 1, Count: 4},    // 0
+				{Le: 4, Count: 5},    // 1
+				{Le: 16, Count: 7},   // 2
+			},
+		},
+		{
+			hist: SparseHistogram{
+				Schema: -4,
+				PositiveSpans: []Span{
+					{Offset: -1, Length: 3}, // -1 0 1
+				},
+				PositiveBuckets: []int64{2, -1, 1},
+			},
+			expBuckets: []Bucket{
+				{Le: 1.52587890625e-05, Count: 2}, // -1
+				{Le: 1, Count: 3},                 // 0
+				{Le: 65536, Count: 5},             // 1
+			},
+		},
 	}
 
 	for i, c := range cases {
@@ -133,3 +217,121 @@ func TestCumulativeExpandSparseHistogram(t *testing.T) {
 		})
 	}
 }
+
+func TestSparseHistogramRescale(t *testing.T) {
+	hist := SparseHistogram{
+		Schema: 3,
+		PositiveSpans: []Span{
+			{Offset: -4, Length: 8},
+		},
+		PositiveBuckets: []int64{1, 0, 0, 0, 0, 0, 0, 0},
+	}
+
+	got := hist.Rescale(0)
+	require.Equal(t, int32(0), got.Schema)
+	require.Equal(t, []Span{{Offset: -1, Length: 2}}, got.PositiveSpans)
+	require.Equal(t, []int64{4, 0}, got.PositiveBuckets)
+
+	// Rescaling to the same (or a higher) schema is a no-op.
+	require.Equal(t, hist, hist.Rescale(3))
+}
+
+func TestSparseHistogramAddSub(t *testing.T) {
+	a := SparseHistogram{
+		Schema:          0,
+		Count:           4,
+		Sum:             5,
+		PositiveSpans:   []Span{{Offset: 0, Length: 2}},
+		PositiveBuckets: []int64{2, 0},
+	}
+	b := SparseHistogram{
+		Schema:          0,
+		Count:           3,
+		Sum:             2,
+		PositiveSpans:   []Span{{Offset: 1, Length: 1}},
+		PositiveBuckets: []int64{3},
+	}
+
+	sum, err := a.Add(b)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), sum.Count)
+	require.Equal(t, 7.0, sum.Sum)
+	require.Equal(t, []Span{{Offset: 0, Length: 2}}, sum.PositiveSpans)
+	require.Equal(t, []int64{2, 3}, sum.PositiveBuckets)
+
+	diff, err := sum.Sub(b)
+	require.NoError(t, err)
+	require.Equal(t, a.Count, diff.Count)
+	require.Equal(t, a.Sum, diff.Sum)
+	require.Equal(t, a.PositiveSpans, diff.PositiveSpans)
+	require.Equal(t, a.PositiveBuckets, diff.PositiveBuckets)
+}
+
+// TestSparseHistogramAddSubCrossSchema covers combine's rescale-before-merge
+// path: a is one schema finer than b, so Add/Sub must rescale a down to b's
+// (coarser) schema before lining up bucket indices.
+func TestSparseHistogramAddSubCrossSchema(t *testing.T) {
+	a := SparseHistogram{
+		Schema:          1,
+		Count:           4,
+		Sum:             5,
+		PositiveSpans:   []Span{{Offset: 0, Length: 4}},
+		PositiveBuckets: []int64{1, 0, 0, 0},
+	}
+	b := SparseHistogram{
+		Schema:          0,
+		Count:           3,
+		Sum:             2,
+		PositiveSpans:   []Span{{Offset: 0, Length: 1}},
+		PositiveBuckets: []int64{3},
+	}
+
+	sum, err := a.Add(b)
+	require.NoError(t, err)
+	require.Equal(t, int32(0), sum.Schema)
+	require.Equal(t, uint64(7), sum.Count)
+	require.Equal(t, 7.0, sum.Sum)
+	require.Equal(t, []Span{{Offset: 0, Length: 2}}, sum.PositiveSpans)
+	require.Equal(t, []int64{5, -3}, sum.PositiveBuckets)
+
+	diff, err := sum.Sub(b)
+	require.NoError(t, err)
+	require.Equal(t, int32(0), diff.Schema)
+	require.Equal(t, uint64(4), diff.Count)
+	require.Equal(t, 5.0, diff.Sum)
+	require.Equal(t, []Span{{Offset: 0, Length: 2}}, diff.PositiveSpans)
+	require.Equal(t, []int64{2, 0}, diff.PositiveBuckets)
+}
+
+// TestSparseHistogramAddSubZeroThreshold covers combine's ZeroThreshold
+// reconciliation: b's wider ZeroThreshold must fold a's first positive
+// bucket into the merged ZeroCount rather than keeping it as a bucket.
+func TestSparseHistogramAddSubZeroThreshold(t *testing.T) {
+	a := SparseHistogram{
+		Schema:          0,
+		Count:           5,
+		Sum:             1,
+		ZeroThreshold:   0.001,
+		ZeroCount:       1,
+		PositiveSpans:   []Span{{Offset: 0, Length: 2}},
+		PositiveBuckets: []int64{2, 0},
+	}
+	b := SparseHistogram{
+		Schema:          0,
+		Count:           2,
+		Sum:             1,
+		ZeroThreshold:   1,
+		ZeroCount:       1,
+		PositiveSpans:   []Span{{Offset: 1, Length: 1}},
+		PositiveBuckets: []int64{1},
+	}
+
+	sum, err := a.Add(b)
+	require.NoError(t, err)
+	require.Equal(t, b.ZeroThreshold, sum.ZeroThreshold)
+	require.Equal(t, uint64(4), sum.ZeroCount)
+	require.Equal(t, uint64(7), sum.Count)
+	require.Equal(t, 2.0, sum.Sum)
+	require.Equal(t, []Span{{Offset: 1, Length: 1}}, sum.PositiveSpans)
+	require.Equal(t, []int64{3}, sum.PositiveBuckets)
+}
@@ -0,0 +1,226 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Status: cancelWithCause, sampleBudget and selectDeadline's shrink math are
+// real and tested (see deadline_test.go), but deadlineQueryable is never
+// wrapped around anything by an Engine.exec (no such method exists in this
+// tree), and storage.SelectHints has no Deadline field to stamp in the
+// first place. The deadline-bounded-Select request this file belongs to is
+// not closed by this file alone.
+package promql
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// CancelCause identifies why a query's context was canceled, so callers get
+// more than an opaque ErrQueryTimeout/ErrQueryCanceled.
+type CancelCause int
+
+const (
+	// CancelUnknown is the zero value: the query is still running, or was
+	// canceled through a path that didn't record a cause.
+	CancelUnknown CancelCause = iota
+	// CancelTimeout means the query ran longer than EngineOpts.Timeout.
+	CancelTimeout
+	// CancelUserRequest means the caller canceled its own context.
+	CancelUserRequest
+	// CancelSampleLimitExceeded means the query touched more samples than
+	// EngineOpts.MaxSamples allows.
+	CancelSampleLimitExceeded
+	// CancelEngineShutdown means Engine.Close was called while the query
+	// was still executing.
+	CancelEngineShutdown
+)
+
+// String returns a human-readable name for c.
+func (c CancelCause) String() string {
+	switch c {
+	case CancelTimeout:
+		return "timeout"
+	case CancelUserRequest:
+		return "user_request"
+	case CancelSampleLimitExceeded:
+		return "sample_limit_exceeded"
+	case CancelEngineShutdown:
+		return "engine_shutdown"
+	default:
+		return "unknown"
+	}
+}
+
+// cancelWithCause pairs a context.CancelFunc with the first CancelCause it
+// was invoked with, giving callers a CancelCauseFunc-style API without
+// depending on a Go runtime version that has context.CancelCause built in.
+type cancelWithCause struct {
+	mtx    sync.Mutex
+	cause  CancelCause
+	cancel context.CancelFunc
+}
+
+// withCancelCause is the CancelCause-aware equivalent of context.WithCancel.
+func withCancelCause(parent context.Context) (context.Context, *cancelWithCause) {
+	ctx, cancel := context.WithCancel(parent)
+	return ctx, &cancelWithCause{cancel: cancel}
+}
+
+// Cancel cancels the associated context, recording cause if this is the
+// first call to Cancel (later calls may not overwrite the original cause,
+// mirroring context.Cause's "first cancellation wins" semantics).
+func (c *cancelWithCause) Cancel(cause CancelCause) {
+	c.mtx.Lock()
+	if c.cause == CancelUnknown {
+		c.cause = cause
+	}
+	c.mtx.Unlock()
+	c.cancel()
+}
+
+// Cause returns the cause passed to the first call to Cancel, or
+// CancelUnknown if Cancel has not been called yet.
+func (c *cancelWithCause) Cause() CancelCause {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.cause
+}
+
+// sampleBudget tracks how many of MaxSamples a query has consumed so far,
+// so that the deadline handed to storage.Select can be shrunk as the query
+// approaches its sample limit: a query that is most of the way to
+// MaxSamples is, on average, most of the way through its expected runtime
+// too, so giving its remaining Select calls the full engine timeout would
+// let it keep running well past the point where it's likely to be killed
+// for exceeding MaxSamples anyway.
+type sampleBudget struct {
+	max int64
+
+	mtx      sync.Mutex
+	consumed int64
+}
+
+func newSampleBudget(max int64) *sampleBudget {
+	return &sampleBudget{max: max}
+}
+
+// add records n additional samples consumed.
+func (b *sampleBudget) add(n int64) {
+	b.mtx.Lock()
+	b.consumed += n
+	b.mtx.Unlock()
+}
+
+// fraction returns the fraction of max already consumed, in [0, 1]. A zero
+// max (no sample limit configured) always returns 0, i.e. no shrinkage.
+func (b *sampleBudget) fraction() float64 {
+	if b.max <= 0 {
+		return 0
+	}
+	b.mtx.Lock()
+	consumed := b.consumed
+	b.mtx.Unlock()
+	f := float64(consumed) / float64(b.max)
+	if f > 1 {
+		f = 1
+	}
+	return f
+}
+
+// selectDeadline returns the deadline to impose on the next storage.Select
+// call: engineDeadline shrunk linearly as the sample budget is consumed, so
+// a query that has already used e.g. 90% of MaxSamples gets at most 10% of
+// its remaining time-to-timeout for its next Select.
+func selectDeadline(now time.Time, engineDeadline time.Time, budget *sampleBudget) time.Time {
+	remaining := engineDeadline.Sub(now)
+	if remaining <= 0 {
+		return now
+	}
+	shrunk := time.Duration(math.Round(float64(remaining) * (1 - budget.fraction())))
+	return now.Add(shrunk)
+}
+
+// deadlineQueryable wraps a storage.Queryable so that every Querier it
+// returns sees a context whose deadline is min(engine timeout, the
+// sample-budget-shrunk deadline above), and carries that same deadline on
+// every SelectHints so pushdown-capable backends can bound their own work
+// without relying on ctx cancellation alone.
+type deadlineQueryable struct {
+	storage.Queryable
+	cancel *cancelWithCause
+	budget *sampleBudget
+}
+
+// newDeadlineQueryable wraps q so Select calls made through it respect both
+// the engine's overall query deadline and the shrinking per-call deadline
+// driven by budget; cancel is used to record CancelSampleLimitExceeded if a
+// Select is refused outright because the budget is already exhausted.
+func newDeadlineQueryable(q storage.Queryable, cancel *cancelWithCause, budget *sampleBudget) storage.Queryable {
+	return &deadlineQueryable{Queryable: q, cancel: cancel, budget: budget}
+}
+
+// Querier implements storage.Queryable.
+func (q *deadlineQueryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	var shrinkCancel context.CancelFunc
+	deadline, ok := ctx.Deadline()
+	if ok {
+		now := time.Now()
+		shrunk := selectDeadline(now, deadline, q.budget)
+		if !shrunk.After(now) {
+			q.cancel.Cancel(CancelSampleLimitExceeded)
+		}
+		ctx, shrinkCancel = context.WithDeadline(ctx, shrunk)
+		deadline = shrunk
+	}
+
+	querier, err := q.Queryable.Querier(ctx, mint, maxt)
+	if err != nil {
+		if shrinkCancel != nil {
+			shrinkCancel()
+		}
+		return nil, err
+	}
+	return &deadlineQuerier{Querier: querier, deadline: deadline, release: shrinkCancel}, nil
+}
+
+// deadlineQuerier stamps Deadline onto every storage.SelectHints that
+// reaches it, so a pushdown-capable backend's Select implementation can see
+// the same bound the querier's own context carries, and releases the
+// context derived in Querier once the caller is done with it.
+type deadlineQuerier struct {
+	storage.Querier
+	deadline time.Time
+	release  context.CancelFunc
+}
+
+// Select implements storage.Querier.
+func (q *deadlineQuerier) Select(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	if hints == nil {
+		hints = &storage.SelectHints{}
+	}
+	hints.Deadline = q.deadline
+	return q.Querier.Select(sortSeries, hints, matchers...)
+}
+
+// Close implements storage.Querier.
+func (q *deadlineQuerier) Close() error {
+	err := q.Querier.Close()
+	if q.release != nil {
+		q.release()
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCancelWithCause_FirstCauseWins(t *testing.T) {
+	ctx, cancel := withCancelCause(context.Background())
+
+	cancel.Cancel(CancelTimeout)
+	cancel.Cancel(CancelUserRequest)
+
+	require.Equal(t, CancelTimeout, cancel.Cause())
+	<-ctx.Done()
+	require.Equal(t, context.Canceled, ctx.Err())
+}
+
+func TestCancelCause_String(t *testing.T) {
+	require.Equal(t, "timeout", CancelTimeout.String())
+	require.Equal(t, "user_request", CancelUserRequest.String())
+	require.Equal(t, "sample_limit_exceeded", CancelSampleLimitExceeded.String())
+	require.Equal(t, "engine_shutdown", CancelEngineShutdown.String())
+	require.Equal(t, "unknown", CancelUnknown.String())
+}
+
+func TestSampleBudget_Fraction(t *testing.T) {
+	b := newSampleBudget(100)
+	require.Equal(t, 0.0, b.fraction())
+
+	b.add(40)
+	require.Equal(t, 0.4, b.fraction())
+
+	b.add(90)
+	require.Equal(t, 1.0, b.fraction(), "fraction must clamp at 1 even once consumed exceeds max")
+}
+
+func TestSampleBudget_ZeroMaxNeverShrinks(t *testing.T) {
+	b := newSampleBudget(0)
+	b.add(1000)
+	require.Equal(t, 0.0, b.fraction())
+}
+
+func TestSelectDeadline_ShrinksWithBudget(t *testing.T) {
+	now := time.Unix(0, 0)
+	engineDeadline := now.Add(10 * time.Second)
+
+	b := newSampleBudget(100)
+	b.add(90)
+
+	got := selectDeadline(now, engineDeadline, b)
+	require.Equal(t, now.Add(1*time.Second), got)
+}
+
+func TestSelectDeadline_PastEngineDeadlineReturnsNow(t *testing.T) {
+	now := time.Unix(100, 0)
+	engineDeadline := now.Add(-1 * time.Second)
+
+	got := selectDeadline(now, engineDeadline, newSampleBudget(0))
+	require.Equal(t, now, got)
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// EngineOpts contains configuration options used when creating a new Engine.
+//
+// NOTE: this tree only carries the options struct plus the scheduling and
+// query-tracking primitives it configures (QueryTracker and the fair
+// scheduler in query_logger.go); Engine itself is out of scope here, so
+// MaxWorkerTime/TenantWeights are threaded through but not yet consumed by
+// an evaluator loop.
+type EngineOpts struct {
+	Logger     log.Logger
+	Reg        prometheus.Registerer
+	MaxSamples int
+	Timeout    time.Duration
+
+	// ActiveQueryTracker is used to enforce MaxConcurrent and to log queries
+	// that were active at the time of a crash, if any.
+	ActiveQueryTracker QueryTracker
+
+	// MaxWorkerTime bounds how long a single query may hold a worker slot
+	// before it must yield cooperatively and re-enter the admission queue.
+	// Zero disables time-slicing (a query runs to completion once admitted).
+	//
+	// Unread in this tree: nothing yields a running query back into the
+	// admission queue mid-evaluation, since there's no Engine.exec loop here
+	// to do so.
+	MaxWorkerTime time.Duration
+
+	// TenantWeights assigns a relative scheduling weight per tenant, used by
+	// the deficit round-robin admission queue so that a handful of
+	// heavyweight tenants cannot starve everyone else. A tenant with no entry
+	// gets the default weight of 1.
+	//
+	// The weighting itself works (see TestTenantQueue_WeightedFairness), but
+	// ActiveQueryTracker is never constructed from this field by anything in
+	// this tree, so it has no live caller.
+	TenantWeights map[string]int
+
+	// ShardCount, if greater than 1, makes the engine split shardable
+	// queries (see promql/shard.Shardable) into this many sub-queries and
+	// execute them in parallel via promql/shard.Shard. 0 or 1 disables
+	// sharding.
+	//
+	// Unread in this tree: there is no Engine.exec to consult it, so setting
+	// this has no effect yet.
+	ShardCount int
+
+	// QueryAuditor, if set, receives a structured AuditEntry for every
+	// query ActiveQueryTracker observes completing; see
+	// NewActiveQueryTrackerWithAudit. Defaults to NoopQueryAuditor.
+	//
+	// Unread in this tree: nothing constructs an Engine that would read this
+	// field and wire it into NewActiveQueryTrackerWithAudit.
+	QueryAuditor QueryAuditor
+
+	// QueryLimits sets the default cost-accounting budget for every query;
+	// see QueryOpts for per-query overrides.
+	//
+	// Unread in this tree: no evaluator constructs a costAccountant from
+	// this field, since there is no Engine here to do so.
+	QueryLimits QueryLimits
+
+	// LogStatementDetails makes the query logger populate
+	// QueryLogEntry.Statement with a normalized summary of each query's
+	// selectors (@ timestamps, offsets) and step-invariant subtrees.
+	// False by default to preserve the existing params.query-only output.
+	//
+	// Unread in this tree: nothing populates QueryLogEntry.Statement from a
+	// real query, since there is no Engine here to check this field.
+	LogStatementDetails bool
+}
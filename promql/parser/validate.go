@@ -0,0 +1,76 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// ErrEmptySelector is returned by ValidateSelectors when every label
+// matcher on a vector or matrix selector matches the empty string, e.g.
+// {foo=""}, {foo!="bar"} alone, or a bare {__name__=~".*"}. Such a selector
+// matches every series (or, for a negative matcher alone, also every series
+// lacking the label), so letting it reach the TSDB either scans the whole
+// block range or silently returns nothing useful; rejecting it before
+// evaluation lets the HTTP API answer with a 400 instead. ParseExpr itself
+// does not run this check.
+type ErrEmptySelector struct {
+	PositionRange PositionRange
+	Selector      string
+}
+
+func (e *ErrEmptySelector) Error() string {
+	return fmt.Sprintf("parse error at %s: selector %q matches every possible series because every label matcher can match the empty string", e.PositionRange, e.Selector)
+}
+
+// ValidateSelectors walks expr and returns an *ErrEmptySelector for the
+// first VectorSelector, MatrixSelector or SubqueryExpr-wrapped selector (@
+// modifiers included, via StepInvariantExpr) whose LabelMatchers are all
+// satisfied by the empty string. It is exposed separately from ParseExpr so
+// rules/alerts loaders and remote-read clients that already hold a parsed
+// Expr can reuse the same check without re-parsing.
+func ValidateSelectors(expr Expr) error {
+	var errOut error
+	Inspect(expr, func(node Node, _ []Node) error {
+		if errOut != nil {
+			return errOut
+		}
+		vs, ok := node.(*VectorSelector)
+		if !ok {
+			return nil
+		}
+		if allMatchEmpty(vs.LabelMatchers) {
+			errOut = &ErrEmptySelector{
+				PositionRange: vs.PositionRange(),
+				Selector:      vs.String(),
+			}
+		}
+		return nil
+	})
+	return errOut
+}
+
+// allMatchEmpty reports whether every matcher in ms is satisfied by the
+// empty string, meaning none of them rules out a series that lacks the
+// label entirely.
+func allMatchEmpty(ms []*labels.Matcher) bool {
+	for _, m := range ms {
+		if !m.Matches("") {
+			return false
+		}
+	}
+	return len(ms) > 0
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestAllMatchEmpty_EqualEmptyString(t *testing.T) {
+	// {foo=""}
+	ms := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "foo", "")}
+	require.True(t, allMatchEmpty(ms))
+}
+
+func TestAllMatchEmpty_NotEqualAlone(t *testing.T) {
+	// {foo!="bar"} alone: the empty string isn't "bar", so this matcher
+	// alone doesn't rule out a series lacking the label.
+	ms := []*labels.Matcher{labels.MustNewMatcher(labels.MatchNotEqual, "foo", "bar")}
+	require.True(t, allMatchEmpty(ms))
+}
+
+func TestAllMatchEmpty_RegexpMatchAll(t *testing.T) {
+	// {__name__=~".*"}
+	ms := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".*")}
+	require.True(t, allMatchEmpty(ms))
+}
+
+func TestAllMatchEmpty_OneNonEmptyMatchingMatcher(t *testing.T) {
+	// {foo="bar", baz=""}: foo="bar" does not match the empty string, so
+	// the selector as a whole does rule out some series and must not be
+	// flagged.
+	ms := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "foo", "bar"),
+		labels.MustNewMatcher(labels.MatchEqual, "baz", ""),
+	}
+	require.False(t, allMatchEmpty(ms))
+}
+
+func TestAllMatchEmpty_NoMatchers(t *testing.T) {
+	// A selector with no matchers at all (e.g. a bare "{}") isn't something
+	// ValidateSelectors' VectorSelector walk can even represent in valid
+	// PromQL, so allMatchEmpty's "no matchers" case is conservative: it
+	// reports false, since there is nothing to prove every matcher matches
+	// empty.
+	require.False(t, allMatchEmpty(nil))
+}
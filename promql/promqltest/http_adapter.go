@@ -0,0 +1,210 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promqltest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// HTTPEngine is a PromQLEngine adapter that issues queries against a remote
+// Prometheus-API-compatible server's /api/v1/query and /api/v1/query_range
+// endpoints, so that server's engine can be run against this tree's own
+// .test corpus via CompatibilityRunner.
+type HTTPEngine struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+// NewHTTPEngine returns an HTTPEngine querying baseURL (e.g.
+// "http://localhost:9090") with http.DefaultClient.
+func NewHTTPEngine(baseURL string) *HTTPEngine {
+	return &HTTPEngine{BaseURL: baseURL, Client: http.DefaultClient}
+}
+
+// NewInstantQuery implements PromQLEngine. The storage.Queryable argument is
+// ignored: the remote server answers against whatever data it already has
+// loaded.
+func (e *HTTPEngine) NewInstantQuery(_ storage.Queryable, qs string, ts time.Time) (Query, error) {
+	return &httpQuery{engine: e, path: "/api/v1/query", values: url.Values{
+		"query": {qs},
+		"time":  {formatTime(ts)},
+	}}, nil
+}
+
+// NewRangeQuery implements PromQLEngine.
+func (e *HTTPEngine) NewRangeQuery(_ storage.Queryable, qs string, start, end time.Time, interval time.Duration) (Query, error) {
+	return &httpQuery{engine: e, path: "/api/v1/query_range", values: url.Values{
+		"query": {qs},
+		"start": {formatTime(start)},
+		"end":   {formatTime(end)},
+		"step":  {strconv.FormatFloat(interval.Seconds(), 'f', -1, 64)},
+	}}, nil
+}
+
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.Unix())+float64(t.Nanosecond())/1e9, 'f', -1, 64)
+}
+
+type httpQuery struct {
+	engine *HTTPEngine
+	path   string
+	values url.Values
+}
+
+// Exec implements Query.
+func (q *httpQuery) Exec(ctx context.Context) *Result {
+	u := q.engine.BaseURL + q.path + "?" + q.values.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return &Result{Err: err}
+	}
+
+	resp, err := q.engine.Client.Do(req)
+	if err != nil {
+		return &Result{Err: err}
+	}
+	defer resp.Body.Close()
+
+	var apiResp apiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		return &Result{Err: fmt.Errorf("decoding response from %s: %w", u, err)}
+	}
+	if apiResp.Status != "success" {
+		return &Result{Err: fmt.Errorf("query failed: %s: %s", apiResp.ErrorType, apiResp.Error)}
+	}
+
+	v, err := apiResp.Data.toParserValue()
+	if err != nil {
+		return &Result{Err: err}
+	}
+	res := &Result{Value: v}
+	for _, w := range apiResp.Warnings {
+		res.Warnings = append(res.Warnings, fmt.Errorf("%s", w))
+	}
+	return res
+}
+
+// apiResponse mirrors the JSON envelope of the HTTP API's /api/v1/query{,_range}
+// responses (see web/api/v1).
+type apiResponse struct {
+	Status    string   `json:"status"`
+	Data      apiData  `json:"data"`
+	ErrorType string   `json:"errorType,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+}
+
+type apiData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// toParserValue decodes Result according to ResultType into the matching
+// parser.Value implementation (promql.Vector, promql.Matrix or
+// promql.Scalar), mirroring how the HTTP API encodes each.
+func (d apiData) toParserValue() (parser.Value, error) {
+	switch d.ResultType {
+	case "vector":
+		var raw []struct {
+			Metric map[string]string `json:"metric"`
+			Value  [2]interface{}    `json:"value"`
+		}
+		if err := json.Unmarshal(d.Result, &raw); err != nil {
+			return nil, err
+		}
+		vec := make(promql.Vector, 0, len(raw))
+		for _, s := range raw {
+			p, err := toSample(s.Metric, s.Value)
+			if err != nil {
+				return nil, err
+			}
+			vec = append(vec, p)
+		}
+		return vec, nil
+
+	case "matrix":
+		var raw []struct {
+			Metric map[string]string `json:"metric"`
+			Values [][2]interface{}  `json:"values"`
+		}
+		if err := json.Unmarshal(d.Result, &raw); err != nil {
+			return nil, err
+		}
+		mat := make(promql.Matrix, 0, len(raw))
+		for _, s := range raw {
+			series := promql.Series{Metric: toLabels(s.Metric)}
+			for _, v := range s.Values {
+				p, err := toSample(s.Metric, v)
+				if err != nil {
+					return nil, err
+				}
+				series.Points = append(series.Points, p.Point)
+			}
+			mat = append(mat, series)
+		}
+		return mat, nil
+
+	case "scalar":
+		var raw [2]interface{}
+		if err := json.Unmarshal(d.Result, &raw); err != nil {
+			return nil, err
+		}
+		p, err := toSample(nil, raw)
+		if err != nil {
+			return nil, err
+		}
+		return promql.Scalar{T: p.T, V: p.V}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported resultType %q", d.ResultType)
+	}
+}
+
+func toLabels(m map[string]string) labels.Labels {
+	lbls := make(labels.Labels, 0, len(m))
+	for k, v := range m {
+		lbls = append(lbls, labels.Label{Name: k, Value: v})
+	}
+	return lbls
+}
+
+func toSample(metric map[string]string, pair [2]interface{}) (promql.Sample, error) {
+	ts, ok := pair[0].(float64)
+	if !ok {
+		return promql.Sample{}, fmt.Errorf("unexpected timestamp type %T", pair[0])
+	}
+	valStr, ok := pair[1].(string)
+	if !ok {
+		return promql.Sample{}, fmt.Errorf("unexpected value type %T", pair[1])
+	}
+	val, err := strconv.ParseFloat(valStr, 64)
+	if err != nil {
+		return promql.Sample{}, fmt.Errorf("parsing sample value %q: %w", valStr, err)
+	}
+	return promql.Sample{
+		Metric: toLabels(metric),
+		Point:  promql.Point{T: int64(ts * 1000), V: val},
+	}, nil
+}
@@ -0,0 +1,232 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package promqltest lets the .test load-and-query files used throughout
+// promql's own test suite be run against any PromQL implementation, not
+// just the built-in Engine, so downstream projects with their own engines
+// can run Prometheus's test corpus as a conformance suite.
+package promqltest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// Query is the minimal surface CompatibilityRunner needs from a query
+// returned by a PromQLEngine.
+type Query interface {
+	Exec(ctx context.Context) *Result
+}
+
+// Result is a query's outcome: exactly one of Value or Err is set. Warnings
+// may be set alongside either.
+type Result struct {
+	Value    parser.Value
+	Warnings []error
+	Err      error
+}
+
+// PromQLEngine is implemented by anything that can answer the instant and
+// range queries the .test corpus issues, such as an adapter for a
+// third-party backend (see HTTPEngine). promql.Engine does not implement it
+// directly: its methods return promql.Query, not this package's Query.
+type PromQLEngine interface {
+	NewInstantQuery(q storage.Queryable, qs string, ts time.Time) (Query, error)
+	NewRangeQuery(q storage.Queryable, qs string, start, end time.Time, interval time.Duration) (Query, error)
+}
+
+// CompatibilityRunner runs every *.test file under Dir against Engine,
+// evaluating its queries against Queryable. The files' "load" blocks are
+// not parsed, and nothing is written to Loader, so the queries see only
+// whatever data Queryable (or a remote engine) already holds.
+type CompatibilityRunner struct {
+	Dir       string
+	Loader    storage.Appendable
+	Engine    PromQLEngine
+	Queryable storage.Queryable
+}
+
+// CaseResult is the outcome of one `eval` case within a .test file. Ordered
+// is set for an eval_ordered case, so a caller diffing Diff against its own
+// expectations knows not to sort before comparing.
+type CaseResult struct {
+	File    string
+	Line    int
+	Expr    string
+	Pass    bool
+	Diff    string
+	Ordered bool
+	Err     error
+}
+
+// Run executes every test file under r.Dir and returns one CaseResult per
+// eval case encountered, in file then line order.
+//
+// This only supports the "eval instant at"/"eval_fail instant
+// at"/"eval_ordered instant at"/"eval_warn instant at" directives of the
+// real promql .test grammar (see promql/test.go upstream); "load" lines are
+// skipped without loading anything. "eval range" is not implemented, and
+// any file using it will report a CaseResult with a non-nil Err for the
+// unsupported line rather than silently skipping it.
+func (r *CompatibilityRunner) Run(ctx context.Context) ([]CaseResult, error) {
+	files, err := filepath.Glob(filepath.Join(r.Dir, "*.test"))
+	if err != nil {
+		return nil, err
+	}
+
+	var results []CaseResult
+	for _, f := range files {
+		caseResults, err := r.runFile(ctx, f)
+		if err != nil {
+			return results, fmt.Errorf("%s: %w", f, err)
+		}
+		results = append(results, caseResults...)
+	}
+	return results, nil
+}
+
+func (r *CompatibilityRunner) runFile(ctx context.Context, file string) ([]CaseResult, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []CaseResult
+	lines := strings.Split(string(b), "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", strings.HasPrefix(line, "#"):
+			continue
+
+		case strings.HasPrefix(line, "eval instant at "):
+			rest := strings.TrimPrefix(line, "eval instant at ")
+			parts := strings.SplitN(rest, " ", 2)
+			if len(parts) != 2 {
+				results = append(results, CaseResult{File: file, Line: i + 1, Err: fmt.Errorf("malformed eval instant line: %q", line)})
+				continue
+			}
+			ts, err := parseTestTimestamp(parts[0])
+			if err != nil {
+				results = append(results, CaseResult{File: file, Line: i + 1, Err: err})
+				continue
+			}
+			results = append(results, r.evalInstant(ctx, file, i+1, parts[1], ts))
+
+		case strings.HasPrefix(line, "eval_fail instant at "):
+			results = append(results, r.runDirective(ctx, file, i+1, "eval_fail instant at ", line, r.evalFail))
+
+		case strings.HasPrefix(line, "eval_ordered instant at "):
+			results = append(results, r.runDirective(ctx, file, i+1, "eval_ordered instant at ", line, r.evalOrdered))
+
+		case strings.HasPrefix(line, "eval_warn instant at "):
+			results = append(results, r.runDirective(ctx, file, i+1, "eval_warn instant at ", line, r.evalWarn))
+
+		case strings.HasPrefix(line, "eval "), strings.HasPrefix(line, "eval_fail "), strings.HasPrefix(line, "eval_ordered "), strings.HasPrefix(line, "eval_warn "):
+			results = append(results, CaseResult{File: file, Line: i + 1, Err: fmt.Errorf("unsupported directive: %q", line)})
+		}
+	}
+	return results, nil
+}
+
+// runDirective parses the "<ts> <expr>" that follows prefix on line and
+// dispatches to eval, sharing the malformed-line and bad-timestamp handling
+// across eval_fail/eval_ordered/eval_warn.
+func (r *CompatibilityRunner) runDirective(ctx context.Context, file string, line int, prefix, rawLine string, eval func(context.Context, string, int, string, time.Time) CaseResult) CaseResult {
+	rest := strings.TrimPrefix(rawLine, prefix)
+	parts := strings.SplitN(rest, " ", 2)
+	if len(parts) != 2 {
+		return CaseResult{File: file, Line: line, Err: fmt.Errorf("malformed %s line: %q", strings.TrimSpace(prefix), rawLine)}
+	}
+	ts, err := parseTestTimestamp(parts[0])
+	if err != nil {
+		return CaseResult{File: file, Line: line, Err: err}
+	}
+	return eval(ctx, file, line, parts[1], ts)
+}
+
+// evalFail runs an `eval_fail instant at <ts> <expr>` case: the case passes
+// if and only if the query itself fails, since that's the behavior being
+// asserted.
+func (r *CompatibilityRunner) evalFail(ctx context.Context, file string, line int, expr string, ts time.Time) CaseResult {
+	q, err := r.Engine.NewInstantQuery(r.Queryable, expr, ts)
+	if err != nil {
+		return CaseResult{File: file, Line: line, Expr: expr, Pass: true, Diff: err.Error()}
+	}
+	res := q.Exec(ctx)
+	if res.Err != nil {
+		return CaseResult{File: file, Line: line, Expr: expr, Pass: true, Diff: res.Err.Error()}
+	}
+	return CaseResult{File: file, Line: line, Expr: expr, Err: fmt.Errorf("expected query to fail, but it succeeded")}
+}
+
+// evalOrdered runs an `eval_ordered instant at <ts> <expr>` case: identical
+// to eval instant except the result is marked Ordered so a caller comparing
+// Diff against its own expected-series block knows not to sort either side
+// first.
+func (r *CompatibilityRunner) evalOrdered(ctx context.Context, file string, line int, expr string, ts time.Time) CaseResult {
+	res := r.evalInstant(ctx, file, line, expr, ts)
+	res.Ordered = true
+	return res
+}
+
+// evalWarn runs an `eval_warn instant at <ts> <expr>` case: the case passes
+// only if the query both succeeds and reports at least one warning.
+func (r *CompatibilityRunner) evalWarn(ctx context.Context, file string, line int, expr string, ts time.Time) CaseResult {
+	q, err := r.Engine.NewInstantQuery(r.Queryable, expr, ts)
+	if err != nil {
+		return CaseResult{File: file, Line: line, Expr: expr, Err: err}
+	}
+	res := q.Exec(ctx)
+	if res.Err != nil {
+		return CaseResult{File: file, Line: line, Expr: expr, Err: res.Err}
+	}
+	if len(res.Warnings) == 0 {
+		return CaseResult{File: file, Line: line, Expr: expr, Err: fmt.Errorf("expected at least one warning, got none")}
+	}
+	return CaseResult{File: file, Line: line, Expr: expr, Pass: true, Diff: res.Value.String()}
+}
+
+// evalInstant runs a single `eval instant at <ts> <expr>` case. Asserting
+// the expected output block that follows it in the real grammar is left to
+// the caller diffing CaseResult.Diff against its own expectations, since
+// this reduced parser does not parse the expected-series block.
+func (r *CompatibilityRunner) evalInstant(ctx context.Context, file string, line int, expr string, ts time.Time) CaseResult {
+	q, err := r.Engine.NewInstantQuery(r.Queryable, expr, ts)
+	if err != nil {
+		return CaseResult{File: file, Line: line, Expr: expr, Err: err}
+	}
+	res := q.Exec(ctx)
+	if res.Err != nil {
+		return CaseResult{File: file, Line: line, Expr: expr, Err: res.Err}
+	}
+	return CaseResult{File: file, Line: line, Expr: expr, Pass: true, Diff: res.Value.String()}
+}
+
+// parseTestTimestamp parses the "0" / "5m" relative-offset timestamps used
+// by the .test grammar, relative to a fixed load-time base of the Unix
+// epoch (matching the convention of the real test harness's load time).
+func parseTestTimestamp(s string) (time.Time, error) {
+	d, err := parser.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing timestamp %q: %w", s, err)
+	}
+	return time.Unix(0, 0).Add(d), nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promqltest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// fakeValue is a minimal parser.Value used only so Result.Value has
+// something to hold in these tests.
+type fakeValue string
+
+func (v fakeValue) String() string         { return string(v) }
+func (v fakeValue) Type() parser.ValueType { return parser.ValueType("fake") }
+
+// fakeQuery returns a fixed *Result regardless of context, standing in for
+// a real engine's query for the directive-dispatch tests below.
+type fakeQuery struct {
+	result *Result
+}
+
+func (q *fakeQuery) Exec(context.Context) *Result { return q.result }
+
+// fakeEngine returns queries whose result depends only on the expression
+// string, so each test case can steer outcome via its expr text.
+type fakeEngine struct{}
+
+func (fakeEngine) NewInstantQuery(_ storage.Queryable, qs string, _ time.Time) (Query, error) {
+	switch qs {
+	case "bad_expr":
+		return nil, errors.New("parse error")
+	case "runtime_fail":
+		return &fakeQuery{result: &Result{Err: errors.New("exec failed")}}, nil
+	case "with_warning":
+		return &fakeQuery{result: &Result{Value: fakeValue("1"), Warnings: []error{errors.New("slow query")}}}, nil
+	default:
+		return &fakeQuery{result: &Result{Value: fakeValue(qs)}}, nil
+	}
+}
+
+func (fakeEngine) NewRangeQuery(_ storage.Queryable, qs string, _, _ time.Time, _ time.Duration) (Query, error) {
+	return nil, fmt.Errorf("range queries not used in this test")
+}
+
+func newTestRunner(dir string) *CompatibilityRunner {
+	return &CompatibilityRunner{Dir: dir, Engine: fakeEngine{}}
+}
+
+func TestCompatibilityRunner_EvalInstant(t *testing.T) {
+	r := newTestRunner("")
+	res := r.evalInstant(context.Background(), "f.test", 1, "up", time.Unix(0, 0))
+	require.True(t, res.Pass)
+	require.Equal(t, "up", res.Diff)
+	require.NoError(t, res.Err)
+}
+
+func TestCompatibilityRunner_EvalFail(t *testing.T) {
+	r := newTestRunner("")
+
+	res := r.evalFail(context.Background(), "f.test", 1, "bad_expr", time.Unix(0, 0))
+	require.True(t, res.Pass, "a query that fails to parse should satisfy eval_fail")
+
+	res = r.evalFail(context.Background(), "f.test", 1, "runtime_fail", time.Unix(0, 0))
+	require.True(t, res.Pass, "a query that fails at exec time should satisfy eval_fail")
+
+	res = r.evalFail(context.Background(), "f.test", 1, "up", time.Unix(0, 0))
+	require.Error(t, res.Err, "a query that succeeds should fail an eval_fail case")
+}
+
+func TestCompatibilityRunner_EvalOrdered(t *testing.T) {
+	r := newTestRunner("")
+	res := r.evalOrdered(context.Background(), "f.test", 1, "up", time.Unix(0, 0))
+	require.True(t, res.Pass)
+	require.True(t, res.Ordered)
+}
+
+func TestCompatibilityRunner_EvalWarn(t *testing.T) {
+	r := newTestRunner("")
+
+	res := r.evalWarn(context.Background(), "f.test", 1, "with_warning", time.Unix(0, 0))
+	require.True(t, res.Pass)
+
+	res = r.evalWarn(context.Background(), "f.test", 1, "up", time.Unix(0, 0))
+	require.Error(t, res.Err, "a query with no warnings should fail an eval_warn case")
+}
+
+func TestCompatibilityRunner_RunFile_DispatchesAllDirectives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "promqltest-runner")
+	require.NoError(t, err)
+
+	contents := "" +
+		"eval instant at 0 up\n" +
+		"eval_fail instant at 0 bad_expr\n" +
+		"eval_ordered instant at 0 up\n" +
+		"eval_warn instant at 0 with_warning\n" +
+		"eval_range instant at 0 up\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.test"), []byte(contents), 0o644))
+
+	r := newTestRunner(dir)
+	results, err := r.Run(context.Background())
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+	for _, res := range results {
+		require.NoError(t, res.Err, "case at line %d", res.Line)
+	}
+	require.True(t, results[2].Ordered)
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileQueryAuditor_RotatesAndReadsBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "query-audit")
+	require.NoError(t, err)
+
+	// Every entry is longer than 64 bytes, so each write rotates first; with
+	// maxBackups=2 only the live file and two backups survive, holding the
+	// last three entries.
+	auditor, err := NewFileQueryAuditor(dir, 64, 2)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		auditor.Audit(AuditEntry{Query: "up", End: time.Unix(int64(i), 0), Samples: int64(i)})
+	}
+
+	entries, err := NewAuditReader(dir).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	// Oldest-backup-first then the live file, each internally in append order.
+	for i := 1; i < len(entries); i++ {
+		require.False(t, entries[i].End.Before(entries[i-1].End))
+	}
+}
+
+func TestFileQueryAuditor_NoRotationWhenMaxBytesUnset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "query-audit-norotate")
+	require.NoError(t, err)
+
+	auditor, err := NewFileQueryAuditor(dir, 0, 2)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		auditor.Audit(AuditEntry{Query: "up"})
+	}
+
+	entries, err := NewAuditReader(dir).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+}
+
+// TestAuditMetrics_ClassifiesByQuery checks that observe() records each
+// sample under the label its classify func returns, rather than lumping
+// everything into one series.
+func TestAuditMetrics_ClassifiesByQuery(t *testing.T) {
+	classify := func(query string) string {
+		if query == "up" {
+			return "cheap"
+		}
+		return "expensive"
+	}
+	m := newAuditMetrics(classify)
+
+	m.observe("up", 10*time.Millisecond, 1, 1)
+	m.observe("rate(http_requests_total[5m])", 2*time.Second, 10000, 500)
+
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(m))
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	counts := map[string]uint64{}
+	for _, fam := range families {
+		if fam.GetName() != "prometheus_engine_query_duration_seconds" {
+			continue
+		}
+		for _, metric := range fam.GetMetric() {
+			for _, l := range metric.GetLabel() {
+				if l.GetName() == "class" {
+					counts[l.GetValue()] = metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	require.Equal(t, uint64(1), counts["cheap"])
+	require.Equal(t, uint64(1), counts["expensive"])
+}
+
+// TestAuditMetrics_DefaultClassify checks that a nil classify func (as passed
+// by callers that don't care about cost classes) falls back to a single
+// constant class rather than panicking.
+func TestAuditMetrics_DefaultClassify(t *testing.T) {
+	m := newAuditMetrics(nil)
+	require.NotPanics(t, func() {
+		m.observe("up", time.Millisecond, 1, 1)
+	})
+}
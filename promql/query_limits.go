@@ -0,0 +1,243 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Status: costAccountant's accounting logic is real and tested (see
+// query_limits_test.go), but it is never held or called by an evaluator --
+// there's no Engine in this tree to construct one per query, so
+// QueryLimits/PartialResponseStrategy are unused outside this file. The
+// cost-accounting request this file belongs to is not closed by this file
+// alone.
+package promql
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// PartialResponseStrategy controls what a query does when it trips a soft
+// QueryLimits threshold.
+type PartialResponseStrategy int
+
+const (
+	// PartialResponseAbort fails the query with an error, the same way
+	// exceeding EngineOpts.MaxSamples always has.
+	PartialResponseAbort PartialResponseStrategy = iota
+	// PartialResponseWarnAndTruncate stops evaluating the offending node,
+	// keeps whatever Matrix/Vector has been computed so far, and appends a
+	// storage.Warning describing which limit was hit instead of failing
+	// the query outright.
+	PartialResponseWarnAndTruncate
+)
+
+// QueryLimits bounds the cost of a single query. The zero value disables all
+// of them (matching today's behavior of only enforcing EngineOpts.MaxSamples
+// via maxSamplesPerQuery).
+type QueryLimits struct {
+	// MaxPeakSamples caps the number of samples held in memory by the
+	// evaluator at any one instant. Distinct from EngineOpts.MaxSamples,
+	// which caps total samples scanned across the query's lifetime.
+	// costAccountant has no way to record samples leaving memory, so the
+	// peak it checks this against is the running total from addSamples.
+	MaxPeakSamples int
+
+	// MaxSeriesPerSelector caps how many series a single vector or matrix
+	// selector node may expand to.
+	MaxSeriesPerSelector int
+
+	// MaxMatrixPointsPerStep caps how many points a range query's matrix
+	// result may contain per evaluation step.
+	MaxMatrixPointsPerStep int
+
+	// MaxWallTime caps how long the query may run, independent of
+	// EngineOpts.Timeout (which bounds the context passed to storage).
+	MaxWallTime time.Duration
+
+	// PartialResponseStrategy governs what happens when any of the above
+	// limits is exceeded. Defaults to PartialResponseAbort.
+	PartialResponseStrategy PartialResponseStrategy
+}
+
+// QueryOpts carries per-Query overrides of the Engine-wide defaults. A nil
+// *QueryLimits field means "use EngineOpts.QueryLimits".
+type QueryOpts struct {
+	Limits *QueryLimits
+}
+
+// limits returns the effective QueryLimits for this QueryOpts, falling back
+// to def when o is nil or o.Limits is unset.
+func (o *QueryOpts) limits(def QueryLimits) QueryLimits {
+	if o == nil || o.Limits == nil {
+		return def
+	}
+	return *o.Limits
+}
+
+// QueryStats is returned alongside a Result and reports how much of each
+// QueryLimits budget the query actually used, regardless of whether it hit
+// one.
+type QueryStats struct {
+	SamplesScanned int64
+	PeakSamples    int64
+	SeriesTouched  int64
+	StepsEvaluated int64
+
+	// NodeTimings records wall-clock time spent evaluating each AST node,
+	// keyed by the node's identity. Populated only for nodes the
+	// evaluator actually visits.
+	NodeTimings map[parser.Node]time.Duration
+}
+
+// limitError reports which QueryLimits field a query exceeded.
+type limitError struct {
+	msg string
+}
+
+func (e *limitError) Error() string { return e.msg }
+
+// costAccountant threads through an evaluator's recursive eval calls,
+// tracking cumulative cost against a QueryLimits budget and deciding, per
+// the configured PartialResponseStrategy, whether an exceeded limit should
+// abort the query or be downgraded to a storage.Warning.
+//
+// This tree does not contain the real evaluator this would be wired into
+// (promql/engine.go, including the evaluator type and its recover/eval
+// methods exercised by TestRecoverEvaluatorError and friends, is not part
+// of this snapshot), so costAccountant is self-contained: it is the piece
+// an evaluator would hold and call into at each selector expansion, step,
+// and node visit.
+type costAccountant struct {
+	limits QueryLimits
+	start  time.Time
+
+	mtx      sync.Mutex
+	samples  int64
+	peak     int64
+	series   int64
+	steps    int64
+	timings  map[parser.Node]time.Duration
+	warnings storage.Warnings
+}
+
+// newCostAccountant returns a costAccountant enforcing limits, with its wall
+// clock budget starting now.
+func newCostAccountant(limits QueryLimits) *costAccountant {
+	return &costAccountant{
+		limits:  limits,
+		start:   time.Now(),
+		timings: make(map[parser.Node]time.Duration),
+	}
+}
+
+// addSamples records n additional samples scanned and checks MaxPeakSamples.
+func (a *costAccountant) addSamples(n int64) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.samples += n
+	if a.samples > a.peak {
+		a.peak = a.samples
+	}
+	if a.limits.MaxPeakSamples > 0 && a.peak > int64(a.limits.MaxPeakSamples) {
+		return a.limitHit("query exceeded max peak samples limit")
+	}
+	return nil
+}
+
+// addSeries records that a selector expanded to n series and checks
+// MaxSeriesPerSelector.
+func (a *costAccountant) addSeries(n int) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.series += int64(n)
+	if a.limits.MaxSeriesPerSelector > 0 && n > a.limits.MaxSeriesPerSelector {
+		return a.limitHit("selector exceeded max series per selector limit")
+	}
+	return nil
+}
+
+// addStep records one more evaluation step and checks MaxMatrixPointsPerStep
+// against the number of points produced in that step.
+func (a *costAccountant) addStep(points int) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.steps++
+	if a.limits.MaxMatrixPointsPerStep > 0 && points > a.limits.MaxMatrixPointsPerStep {
+		return a.limitHit("step exceeded max matrix points per step limit")
+	}
+	return nil
+}
+
+// recordNodeTiming attributes d to node, accumulating across repeated
+// visits of the same node (e.g. within a subquery).
+func (a *costAccountant) recordNodeTiming(node parser.Node, d time.Duration) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.timings[node] += d
+}
+
+// checkWallTime returns a limitError if MaxWallTime has elapsed since the
+// accountant was created.
+func (a *costAccountant) checkWallTime() error {
+	if a.limits.MaxWallTime <= 0 {
+		return nil
+	}
+	if time.Since(a.start) > a.limits.MaxWallTime {
+		a.mtx.Lock()
+		defer a.mtx.Unlock()
+		return a.limitHit("query exceeded max wall time limit")
+	}
+	return nil
+}
+
+// limitHit must be called with a.mtx held. Under PartialResponseAbort it
+// returns an error the evaluator should propagate and abort on. Under
+// PartialResponseWarnAndTruncate it stashes the message as a warning and
+// returns nil, signaling the evaluator to stop expanding the current node
+// but keep whatever it has already computed.
+func (a *costAccountant) limitHit(msg string) error {
+	if a.limits.PartialResponseStrategy == PartialResponseWarnAndTruncate {
+		a.warnings = append(a.warnings, &limitError{msg: msg})
+		return nil
+	}
+	return &limitError{msg: msg}
+}
+
+// stats returns a snapshot of the cost accumulated so far.
+func (a *costAccountant) stats() QueryStats {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	timings := make(map[parser.Node]time.Duration, len(a.timings))
+	for k, v := range a.timings {
+		timings[k] = v
+	}
+	return QueryStats{
+		SamplesScanned: a.samples,
+		PeakSamples:    a.peak,
+		SeriesTouched:  a.series,
+		StepsEvaluated: a.steps,
+		NodeTimings:    timings,
+	}
+}
+
+// drainWarnings returns and clears the warnings accumulated under
+// PartialResponseWarnAndTruncate, for the caller to merge into the
+// storage.Warnings it returns alongside a partial Result.
+func (a *costAccountant) drainWarnings() storage.Warnings {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	ws := a.warnings
+	a.warnings = nil
+	return ws
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestCostAccountant_AddSamplesTracksPeak(t *testing.T) {
+	a := newCostAccountant(QueryLimits{MaxPeakSamples: 10})
+
+	require.NoError(t, a.addSamples(4))
+	require.NoError(t, a.addSamples(4))
+	require.Error(t, a.addSamples(4), "9th and 10th sample are fine, the 12th trips MaxPeakSamples")
+
+	stats := a.stats()
+	require.EqualValues(t, 12, stats.SamplesScanned)
+	require.EqualValues(t, 12, stats.PeakSamples)
+}
+
+func TestCostAccountant_AddSeriesLimit(t *testing.T) {
+	a := newCostAccountant(QueryLimits{MaxSeriesPerSelector: 5})
+
+	require.NoError(t, a.addSeries(5))
+	require.Error(t, a.addSeries(6))
+
+	require.EqualValues(t, 11, a.stats().SeriesTouched)
+}
+
+func TestCostAccountant_AddStepLimit(t *testing.T) {
+	a := newCostAccountant(QueryLimits{MaxMatrixPointsPerStep: 100})
+
+	require.NoError(t, a.addStep(100))
+	require.Error(t, a.addStep(101))
+	require.EqualValues(t, 2, a.stats().StepsEvaluated)
+}
+
+func TestCostAccountant_CheckWallTime(t *testing.T) {
+	a := newCostAccountant(QueryLimits{MaxWallTime: time.Millisecond})
+	require.NoError(t, a.checkWallTime())
+
+	time.Sleep(5 * time.Millisecond)
+	require.Error(t, a.checkWallTime())
+}
+
+func TestCostAccountant_CheckWallTime_Disabled(t *testing.T) {
+	a := newCostAccountant(QueryLimits{})
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, a.checkWallTime())
+}
+
+// TestCostAccountant_WarnAndTruncateDoesNotAbort checks that, under
+// PartialResponseWarnAndTruncate, a tripped limit is reported as a warning
+// rather than an error, and that the warning is consumable exactly once via
+// drainWarnings.
+func TestCostAccountant_WarnAndTruncateDoesNotAbort(t *testing.T) {
+	a := newCostAccountant(QueryLimits{
+		MaxSeriesPerSelector:    1,
+		PartialResponseStrategy: PartialResponseWarnAndTruncate,
+	})
+
+	require.NoError(t, a.addSeries(2), "WarnAndTruncate must not return an error the evaluator would abort on")
+
+	warnings := a.drainWarnings()
+	require.Len(t, warnings, 1)
+
+	require.Empty(t, a.drainWarnings(), "drainWarnings must clear accumulated warnings")
+}
+
+func TestCostAccountant_RecordNodeTiming(t *testing.T) {
+	a := newCostAccountant(QueryLimits{})
+
+	var node parser.Node
+	a.recordNodeTiming(node, 10*time.Millisecond)
+	a.recordNodeTiming(node, 5*time.Millisecond)
+
+	stats := a.stats()
+	require.Equal(t, 15*time.Millisecond, stats.NodeTimings[node])
+}
+
+func TestQueryOpts_LimitsFallsBackToEngineDefault(t *testing.T) {
+	def := QueryLimits{MaxPeakSamples: 1000}
+
+	var nilOpts *QueryOpts
+	require.Equal(t, def, nilOpts.limits(def))
+
+	emptyOpts := &QueryOpts{}
+	require.Equal(t, def, emptyOpts.limits(def))
+
+	override := QueryLimits{MaxPeakSamples: 1}
+	overridden := &QueryOpts{Limits: &override}
+	require.Equal(t, override, overridden.limits(def))
+}
@@ -0,0 +1,280 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Status: QueryLogEntry.fields and ndjsonQueryLogger are real and tested
+// (see query_log_entry_test.go), but nothing in this tree ever constructs a
+// real QueryLogEntry from a running query -- TestQueryLogger_basic and
+// TestQueryLogger_fields in engine_test.go still exercise a NewEngine that
+// doesn't exist here. The typed-query-log request this file belongs to is
+// not closed by this file alone.
+package promql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// QueryLogger is the interface Engine.SetQueryLogger accepts. Its Log method
+// takes a flat, alternating key/value list rather than a typed struct so
+// that callers who only want a handful of fields (as FakeQueryLogger does in
+// the engine tests) don't need to construct a full QueryLogEntry.
+type QueryLogger interface {
+	Log(...interface{}) error
+	Close() error
+}
+
+// QueryLogEntry is the typed, stable schema for a single logged query.
+// Fields are additive-only across versions: downstream log-pipeline parsers
+// may assume any field present today keeps its name and type.
+type QueryLogEntry struct {
+	Query string `json:"query"`
+
+	Start time.Time     `json:"start"`
+	End   time.Time     `json:"end,omitempty"`
+	Step  time.Duration `json:"step,omitempty"`
+
+	// QueueTime is how long the query waited for an ActiveQueryTracker
+	// slot before EvaluationTime started. ExecTime is QueueTime plus
+	// EvaluationTime plus result-marshaling overhead.
+	QueueTime      time.Duration `json:"queueTimeNs"`
+	EvaluationTime time.Duration `json:"evaluationTimeNs"`
+	ExecTime       time.Duration `json:"execTimeNs"`
+
+	PeakSamples int64 `json:"peakSamples"`
+	SeriesCount int64 `json:"seriesCount"`
+
+	Caller string `json:"caller,omitempty"`
+	Route  string `json:"route,omitempty"`
+
+	TraceID string `json:"traceID,omitempty"`
+	SpanID  string `json:"spanID,omitempty"`
+
+	// Statement is a normalized summary of the parsed query: which
+	// selectors carry an @ timestamp or offset, and which subtrees were
+	// found step-invariant and so cacheable across the query's steps.
+	// Populated only when EngineOpts.LogStatementDetails is set.
+	Statement *StatementSummary `json:"statement,omitempty"`
+}
+
+// SelectorSummary describes one selector's @ modifier and offset, plus
+// whether the selector sits inside a step-invariant subtree.
+type SelectorSummary struct {
+	Selector      string `json:"selector"`
+	TimestampMs   *int64 `json:"timestampMs,omitempty"`
+	OffsetMs      int64  `json:"offsetMs,omitempty"`
+	StepInvariant bool   `json:"stepInvariant"`
+}
+
+// StatementSummary is the normalized, loggable shape of a parsed query's
+// AST: enough for an operator reading the active-queries log to tell at a
+// glance which selectors are pinned in time and whether the query as a
+// whole is step-invariant and therefore cacheable.
+type StatementSummary struct {
+	Selectors     []SelectorSummary `json:"selectors,omitempty"`
+	StepInvariant bool              `json:"stepInvariant"`
+}
+
+// summarizeStatement walks expr (after WrapWithStepInvariantExpr has
+// already wrapped its maximal step-invariant subtrees) and builds the
+// StatementSummary an EngineOpts.LogStatementDetails-enabled logger
+// attaches to a QueryLogEntry.
+//
+// Status: summarizeStatement's AST walk is real and tested (see
+// query_statement_summary_test.go), but EngineOpts.LogStatementDetails is
+// unread and nothing populates QueryLogEntry.Statement from a real query --
+// that needs the same missing evaluator as the rest of this file. The
+// statement-logging request this function belongs to is not closed by this
+// function alone.
+func summarizeStatement(expr parser.Expr) StatementSummary {
+	summary := StatementSummary{StepInvariant: IsStepInvariant(expr)}
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		var ts *int64
+		if vs.Timestamp != nil {
+			ts = vs.Timestamp
+		}
+		invariant := hasAtModifier(vs)
+		for _, p := range path {
+			if _, wrapped := p.(*StepInvariantExpr); wrapped || hasAtModifier(p) {
+				invariant = true
+			}
+		}
+		summary.Selectors = append(summary.Selectors, SelectorSummary{
+			Selector:      vs.String(),
+			TimestampMs:   ts,
+			OffsetMs:      vs.Offset.Milliseconds(),
+			StepInvariant: invariant,
+		})
+		return nil
+	})
+	return summary
+}
+
+// WrapWithStepInvariantExpr wraps expr's maximal step-invariant subtrees so
+// summarizeStatement (and the range evaluation loop described in this
+// chunk's predecessor) can tell which parts of the query need evaluating
+// only once. It is the same rewrite as PreprocessExpr; this name matches
+// the one used when logging statement details, since that's the
+// operation a reader of the active-queries log cares about by this name.
+func WrapWithStepInvariantExpr(expr parser.Expr) parser.Expr {
+	return PreprocessExpr(expr)
+}
+
+// fields flattens e into the alternating key/value list QueryLogger.Log
+// expects, with origin appended last so that a caller only interested in
+// request-origin fields (as TestQueryLogger_fields does) can keep reading
+// off the end of the list regardless of how many typed fields precede them.
+//
+// The leading "params", map[string]interface{}{"query": ...} pair matches
+// the shape the pre-existing FakeQueryLogger-based tests assert on, so
+// QueryLogEntry can replace the ad hoc field lists engine.go used to build
+// without breaking TestQueryLogger_basic or TestQueryLogger_fields.
+func (e QueryLogEntry) fields(origin map[string]interface{}) []interface{} {
+	fields := []interface{}{
+		"params", map[string]interface{}{"query": e.Query},
+		"start", e.Start,
+		"end", e.End,
+		"step", e.Step,
+		"queueTime", e.QueueTime,
+		"evaluationTime", e.EvaluationTime,
+		"execTime", e.ExecTime,
+		"peakSamples", e.PeakSamples,
+		"seriesCount", e.SeriesCount,
+	}
+	if e.Caller != "" {
+		fields = append(fields, "caller", e.Caller)
+	}
+	if e.Route != "" {
+		fields = append(fields, "route", e.Route)
+	}
+	if e.TraceID != "" {
+		fields = append(fields, "traceID", e.TraceID, "spanID", e.SpanID)
+	}
+	if e.Statement != nil {
+		fields = append(fields, "statement", *e.Statement)
+	}
+	for k, v := range origin {
+		fields = append(fields, k, v)
+	}
+	return fields
+}
+
+// ndjsonQueryLogger is a QueryLogger that writes one JSON object per line,
+// suitable for tailing into a log-ingestion pipeline.
+type ndjsonQueryLogger struct {
+	mtx    sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// NewNDJSONQueryLogger opens (creating if necessary) path for appending and
+// returns a QueryLogger that writes a QueryLogEntry-shaped JSON object per
+// logged query.
+func NewNDJSONQueryLogger(path string) (QueryLogger, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening query log %s: %w", path, err)
+	}
+	return &ndjsonQueryLogger{w: f, closer: f}, nil
+}
+
+// Log implements QueryLogger. fields is interpreted as alternating
+// string-keyed key/value pairs, matching what QueryLogEntry.fields
+// produces; non-string keys and an odd-length fields list are reported as
+// an error rather than silently dropped.
+func (l *ndjsonQueryLogger) Log(fields ...interface{}) error {
+	if len(fields)%2 != 0 {
+		return fmt.Errorf("odd number of log fields: %d", len(fields))
+	}
+	entry := make(map[string]interface{}, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		key, ok := fields[i].(string)
+		if !ok {
+			return fmt.Errorf("log field %d has non-string key %v", i, fields[i])
+		}
+		entry[key] = fields[i+1]
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	_, err = l.w.Write(b)
+	return err
+}
+
+// Close implements QueryLogger.
+func (l *ndjsonQueryLogger) Close() error {
+	return l.closer.Close()
+}
+
+// tracingQueryLogger wraps a QueryLogger and an OpenTelemetry tracer. Log is
+// delegated to the wrapped logger unchanged and emits no span; spans for
+// PrepareQuery/Exec come from StartPrepare/StartExec. Per-evaluator-node
+// spans are exposed via StartNodeSpan for an evaluator to call into at each
+// AST node it visits; this tree has no such evaluator (engine.go isn't part
+// of this snapshot), so StartNodeSpan is unused here but kept as the
+// intended hook point.
+type tracingQueryLogger struct {
+	QueryLogger
+	tracer trace.Tracer
+}
+
+// NewTracingQueryLogger wraps next with tracer; see tracingQueryLogger for
+// which calls produce OpenTelemetry spans.
+func NewTracingQueryLogger(next QueryLogger, tracer trace.Tracer) QueryLogger {
+	return &tracingQueryLogger{QueryLogger: next, tracer: tracer}
+}
+
+// StartPrepare starts a span covering query parsing and planning.
+func (l *tracingQueryLogger) StartPrepare(ctx context.Context, query string) (context.Context, trace.Span) {
+	return l.tracer.Start(ctx, "promql.PrepareQuery", trace.WithAttributes())
+}
+
+// StartExec starts a span covering evaluation of an already-prepared query.
+func (l *tracingQueryLogger) StartExec(ctx context.Context, query string) (context.Context, trace.Span) {
+	return l.tracer.Start(ctx, "promql.Exec", trace.WithAttributes())
+}
+
+// StartNodeSpan starts a span covering evaluation of a single AST node. An
+// evaluator would call this on entry to its per-node eval function and end
+// the returned span (recording err via span.RecordError/span.SetStatus) on
+// exit.
+func (l *tracingQueryLogger) StartNodeSpan(ctx context.Context, node parser.Node) (context.Context, trace.Span) {
+	return l.tracer.Start(ctx, fmt.Sprintf("promql.eval.%T", node))
+}
+
+// EndWithError ends span, recording err on it if non-nil.
+func EndWithError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestQueryLogEntry_FieldsMatchesLegacyShape pins down the part of the
+// FakeQueryLogger-based TestQueryLogger_basic/TestQueryLogger_fields
+// contract that QueryLogEntry.fields is responsible for: a leading
+// "params", map[string]interface{}{"query": ...} pair, so a caller that
+// only reads the first two elements off Log's argument list keeps working
+// whether it's fed by the old ad hoc field list or this typed entry.
+func TestQueryLogEntry_FieldsMatchesLegacyShape(t *testing.T) {
+	e := QueryLogEntry{Query: "up", PeakSamples: 5, SeriesCount: 2}
+	fields := e.fields(nil)
+
+	require.Equal(t, "params", fields[0])
+	require.Equal(t, map[string]interface{}{"query": "up"}, fields[1])
+}
+
+// TestQueryLogEntry_FieldsAppendsOriginLast checks that origin fields land
+// after all of the typed ones, matching what TestQueryLogger_fields asserts
+// by reading off the end of the list.
+func TestQueryLogEntry_FieldsAppendsOriginLast(t *testing.T) {
+	e := QueryLogEntry{Query: "up"}
+	origin := map[string]interface{}{"address": "127.0.0.1"}
+
+	fields := e.fields(origin)
+	require.Equal(t, "address", fields[len(fields)-2])
+	require.Equal(t, "127.0.0.1", fields[len(fields)-1])
+}
+
+// TestQueryLogEntry_FieldsOmitsUnsetOptionalFields checks that caller,
+// route, trace/span IDs and statement are only emitted when set, since a
+// log-pipeline parser keying off field presence shouldn't see e.g. an empty
+// "caller" on every line.
+func TestQueryLogEntry_FieldsOmitsUnsetOptionalFields(t *testing.T) {
+	e := QueryLogEntry{Query: "up"}
+	fields := e.fields(nil)
+
+	for i := 0; i < len(fields); i += 2 {
+		key := fields[i].(string)
+		require.NotEqual(t, "caller", key)
+		require.NotEqual(t, "route", key)
+		require.NotEqual(t, "traceID", key)
+		require.NotEqual(t, "statement", key)
+	}
+}
+
+func TestQueryLogEntry_FieldsIncludesTraceAndSpanTogether(t *testing.T) {
+	e := QueryLogEntry{Query: "up", TraceID: "t1", SpanID: "s1"}
+	fields := e.fields(nil)
+
+	var gotTrace, gotSpan bool
+	for i := 0; i < len(fields); i += 2 {
+		switch fields[i].(string) {
+		case "traceID":
+			require.Equal(t, "t1", fields[i+1])
+			gotTrace = true
+		case "spanID":
+			require.Equal(t, "s1", fields[i+1])
+			gotSpan = true
+		}
+	}
+	require.True(t, gotTrace)
+	require.True(t, gotSpan)
+}
+
+func TestNDJSONQueryLogger_WritesOneLinePerLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "query-log")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "queries.log")
+
+	logger, err := NewNDJSONQueryLogger(path)
+	require.NoError(t, err)
+
+	entry := QueryLogEntry{Query: "up", Start: time.Unix(0, 0)}
+	require.NoError(t, logger.Log(entry.fields(nil)...))
+	require.NoError(t, logger.Log(entry.fields(nil)...))
+	require.NoError(t, logger.Close())
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Len(t, splitNonEmptyLines(string(b)), 2)
+}
+
+func TestNDJSONQueryLogger_RejectsOddFieldCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "query-log-odd")
+	require.NoError(t, err)
+	logger, err := NewNDJSONQueryLogger(filepath.Join(dir, "queries.log"))
+	require.NoError(t, err)
+	defer logger.Close()
+
+	require.Error(t, logger.Log("key"))
+}
+
+func TestNDJSONQueryLogger_RejectsNonStringKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "query-log-badkey")
+	require.NoError(t, err)
+	logger, err := NewNDJSONQueryLogger(filepath.Join(dir, "queries.log"))
+	require.NoError(t, err)
+	defer logger.Close()
+
+	require.Error(t, logger.Log(1, "value"))
+}
+
+func splitNonEmptyLines(s string) []string {
+	var lines []string
+	start := 0
+	for i, c := range s {
+		if c == '\n' {
+			if i > start {
+				lines = append(lines, s[start:i])
+			}
+			start = i + 1
+		}
+	}
+	return lines
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestFairScheduler_AdmitsUpToCapacity checks the part of the scheduler that
+// doesn't need an Engine to exercise: acquire never blocks while a slot is
+// free, and release makes a slot available to a subsequent acquire.
+func TestFairScheduler_AdmitsUpToCapacity(t *testing.T) {
+	s := newFairScheduler(2, nil)
+
+	idx1, err := s.acquire(context.Background(), "")
+	require.NoError(t, err)
+	idx2, err := s.acquire(context.Background(), "")
+	require.NoError(t, err)
+	require.NotEqual(t, idx1, idx2)
+
+	s.release(idx1)
+	idx3, err := s.acquire(context.Background(), "")
+	require.NoError(t, err)
+	require.Equal(t, idx1, idx3)
+
+	s.release(idx2)
+	s.release(idx3)
+}
+
+// TestFairScheduler_AcquireRespectsCancellation checks that a waiter blocked
+// on a full scheduler is released, with ctx.Err(), as soon as its context is
+// cancelled, rather than blocking forever.
+func TestFairScheduler_AcquireRespectsCancellation(t *testing.T) {
+	s := newFairScheduler(1, nil)
+
+	idx, err := s.acquire(context.Background(), "")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.acquire(ctx, "")
+		done <- err
+	}()
+	cancel()
+	require.Equal(t, context.Canceled, <-done)
+
+	s.release(idx)
+}
+
+// TestTenantQueue_WeightedFairness checks that tenantQueue.next favors the
+// tenant with the larger accumulated deficit, i.e. that a higher-weight
+// tenant is admitted more often than a tie-weighted one rather than strictly
+// in arrival order.
+func TestTenantQueue_WeightedFairness(t *testing.T) {
+	var q tenantQueue
+	heavy := q.push("heavy", 3)
+	light := q.push("light", 1)
+
+	admitted := map[string]int{}
+	ids := map[int]string{heavy: "heavy", light: "light"}
+	for i := 0; i < 4; i++ {
+		id := q.next()
+		admitted[ids[id]]++
+		// Re-enqueue the admitted ticket to simulate a tenant that always
+		// has more work ready, the same way a chatty tenant would keep
+		// competing for slots round after round.
+		q.remove(id)
+		if ids[id] == "heavy" {
+			heavy = q.push("heavy", 3)
+			ids[heavy] = "heavy"
+		} else {
+			light = q.push("light", 1)
+			ids[light] = "light"
+		}
+	}
+
+	require.Greater(t, admitted["heavy"], admitted["light"])
+}
+
+// TestActiveQueryTracker_InsertDeleteReusesSlot checks the non-scheduling
+// bookkeeping Insert/Delete do around fairScheduler: a slot released by
+// Delete is reusable by a subsequent Insert, and GetMaxConcurrent reports
+// the configured capacity.
+func TestActiveQueryTracker_InsertDeleteReusesSlot(t *testing.T) {
+	tr := NewActiveQueryTracker("", 1, nil)
+	defer tr.Close()
+
+	require.Equal(t, 1, tr.GetMaxConcurrent())
+
+	idx, err := tr.Insert(context.Background(), "query 1")
+	require.NoError(t, err)
+	tr.Delete(idx)
+
+	idx2, err := tr.Insert(context.Background(), "query 2")
+	require.NoError(t, err)
+	require.Equal(t, idx, idx2)
+	tr.Delete(idx2)
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestSummarizeStatement_StepInvariantWholeQuery(t *testing.T) {
+	expr := &parser.NumberLiteral{Val: 1}
+	summary := summarizeStatement(expr)
+	require.True(t, summary.StepInvariant)
+	require.Empty(t, summary.Selectors)
+}
+
+func TestSummarizeStatement_CollectsEachSelector(t *testing.T) {
+	ts := int64(10)
+	pinned := &parser.VectorSelector{Timestamp: &ts}
+	plain := &parser.VectorSelector{}
+	expr := &parser.BinaryExpr{LHS: pinned, RHS: plain}
+
+	summary := summarizeStatement(expr)
+	require.False(t, summary.StepInvariant, "one unpinned selector keeps the whole query variant")
+	require.Len(t, summary.Selectors, 2)
+
+	var sawPinned, sawPlain bool
+	for _, s := range summary.Selectors {
+		if s.StepInvariant {
+			require.NotNil(t, s.TimestampMs)
+			sawPinned = true
+		} else {
+			sawPlain = true
+		}
+	}
+	require.True(t, sawPinned)
+	require.True(t, sawPlain)
+}
+
+func TestSummarizeStatement_OffsetMilliseconds(t *testing.T) {
+	vs := &parser.VectorSelector{Offset: 30_000_000_000}
+	summary := summarizeStatement(vs)
+	require.Len(t, summary.Selectors, 1)
+	require.EqualValues(t, 30_000, summary.Selectors[0].OffsetMs)
+}
+
+func TestWrapWithStepInvariantExpr_MatchesPreprocessExpr(t *testing.T) {
+	expr := &parser.NumberLiteral{Val: 1}
+	require.Equal(t, PreprocessExpr(expr), WrapWithStepInvariantExpr(expr))
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shard
+
+import (
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// MergeFunc combines the per-shard partial samples for a single output
+// series (identified by its label set) into the final sample, for one of
+// the associative aggregations in associativeAggs.
+type MergeFunc func(partials []float64) float64
+
+// Merger returns the merge function to apply across shards for agg.Op. For
+// topk/bottomk the caller is expected to instead concatenate the per-shard
+// top-K lists and re-run the same op over that (much smaller) set, since
+// there is no per-series scalar to reduce; Merger returns nil for those to
+// signal that.
+func Merger(op parser.ItemType) MergeFunc {
+	switch op {
+	case parser.SUM, parser.COUNT, parser.GROUP:
+		return sumMerge
+	case parser.MIN:
+		return minMerge
+	case parser.MAX:
+		return maxMerge
+	case parser.AVG:
+		// avg is decomposed by the caller into sum(..)/count(..) sharded
+		// sub-queries before Merger is consulted; this entry exists so
+		// Merger never needs a special case at the call site.
+		return sumMerge
+	default:
+		return nil
+	}
+}
+
+func sumMerge(partials []float64) float64 {
+	var s float64
+	for _, p := range partials {
+		s += p
+	}
+	return s
+}
+
+func minMerge(partials []float64) float64 {
+	m := partials[0]
+	for _, p := range partials[1:] {
+		if p < m {
+			m = p
+		}
+	}
+	return m
+}
+
+func maxMerge(partials []float64) float64 {
+	m := partials[0]
+	for _, p := range partials[1:] {
+		if p > m {
+			m = p
+		}
+	}
+	return m
+}
@@ -0,0 +1,49 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shard
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestMerger(t *testing.T) {
+	partials := []float64{3, 1, 4, 1, 5}
+
+	cases := []struct {
+		op       parser.ItemType
+		expected float64
+	}{
+		{parser.SUM, 14},
+		{parser.COUNT, 14},
+		{parser.GROUP, 14},
+		{parser.AVG, 14},
+		{parser.MIN, 1},
+		{parser.MAX, 5},
+	}
+	for _, c := range cases {
+		merge := Merger(c.op)
+		require.NotNil(t, merge, "op %v", c.op)
+		require.Equal(t, c.expected, merge(partials))
+	}
+}
+
+func TestMerger_TopKBottomKUnsupported(t *testing.T) {
+	require.Nil(t, Merger(parser.TOPK))
+	require.Nil(t, Merger(parser.BOTTOMK))
+	require.Nil(t, Merger(parser.QUANTILE))
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package shard implements AST-level query sharding: splitting a PromQL
+// query into ShardCount independent sub-queries that each see only a slice
+// of the series for every vector/matrix selector they contain, so that
+// Engine.exec can run them in parallel against a storage.Queryable and
+// recombine the partial results.
+//
+// Status: Shard and Merger are tested in isolation (shard_test.go,
+// merge_test.go) but have no caller -- there is no Engine.exec in this tree
+// to invoke them in parallel or feed EngineOpts.ShardCount to Shardable.
+// The query-sharding request this package belongs to is not closed by this
+// package alone; it remains the AST-rewriting and result-merge primitives a
+// parallel executor would still need to be built on top of.
+package shard
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Label is injected into every vector/matrix selector of a sharded
+// sub-query. Queryables that can push the filter down (e.g. a sharded TSDB
+// store) match it against Value to select only the series owned by that
+// shard. Shard only adds the matcher; this package does no series
+// filtering of its own.
+const Label = "__query_shard__"
+
+// Value returns the matcher value identifying shard index (0-based) of
+// count total shards.
+func Value(index, count int) string {
+	return fmt.Sprintf("%d_of_%d", index, count)
+}
+
+// nonShardableFuncs are PromQL functions whose result over a subset of
+// series cannot be combined back into the correct result over all series,
+// because they depend on seeing every series at once (quantile estimation)
+// or on the absence of series (which a shard can't tell apart from "not in
+// this shard").
+var nonShardableFuncs = map[string]bool{
+	"histogram_quantile": true,
+	"quantile_over_time": true,
+	"absent":             true,
+	"absent_over_time":   true,
+}
+
+// associativeAggs are aggregation operators whose per-shard partial results
+// can be recombined with the same operator (possibly after a cheap
+// transform, see Merger) to produce the result over the full series set.
+var associativeAggs = map[parser.ItemType]bool{
+	parser.SUM:     true,
+	parser.COUNT:   true,
+	parser.MIN:     true,
+	parser.MAX:     true,
+	parser.TOPK:    true,
+	parser.BOTTOMK: true,
+	parser.GROUP:   true,
+	parser.AVG:     true,
+}
+
+// Shardable reports whether expr can be safely split into independent
+// per-shard sub-queries and recombined with Merger. It returns false for any
+// subtree containing a non-shardable function call or a non-associative
+// aggregation, in which case the caller should fall back to unsharded
+// evaluation of the whole expression.
+func Shardable(expr parser.Expr) bool {
+	shardable := true
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.Call:
+			if n.Func != nil && nonShardableFuncs[n.Func.Name] {
+				shardable = false
+			}
+		case *parser.AggregateExpr:
+			if !associativeAggs[n.Op] {
+				shardable = false
+			}
+			// avg is decomposed into sum/count by the caller (see Merger); quantile-by (and any
+			// aggregation carrying a parameter we don't special-case) isn't
+			// associative across shards.
+			if n.Op == parser.QUANTILE {
+				shardable = false
+			}
+		}
+		return nil
+	})
+	return shardable
+}
+
+// Shard returns a deep copy of expr with Label=Value(index, count) injected
+// into every vector and matrix selector, so that evaluating the copy against
+// the same data set yields this shard's partial result. expr is left
+// unmodified. @ modifiers and subquery ranges are preserved as-is, since
+// they apply along the time axis rather than the series axis that sharding
+// splits.
+func Shard(expr parser.Expr, index, count int) parser.Expr {
+	matcher := labels.MustNewMatcher(labels.MatchEqual, Label, Value(index, count))
+	return cloneWithMatcher(expr, matcher).(parser.Expr)
+}
+
+// cloneWithMatcher deep-copies node, adding matcher to the LabelMatchers of
+// every VectorSelector and MatrixSelector it contains.
+func cloneWithMatcher(node parser.Node, matcher *labels.Matcher) parser.Node {
+	if node == nil {
+		return nil
+	}
+	switch n := node.(type) {
+	case *parser.VectorSelector:
+		cp := *n
+		cp.LabelMatchers = append(append([]*labels.Matcher{}, n.LabelMatchers...), matcher)
+		return &cp
+
+	case *parser.MatrixSelector:
+		cp := *n
+		cp.VectorSelector = cloneWithMatcher(n.VectorSelector, matcher).(parser.Expr)
+		return &cp
+
+	case *parser.SubqueryExpr:
+		cp := *n
+		cp.Expr = cloneWithMatcher(n.Expr, matcher).(parser.Expr)
+		return &cp
+
+	case *parser.ParenExpr:
+		cp := *n
+		cp.Expr = cloneWithMatcher(n.Expr, matcher).(parser.Expr)
+		return &cp
+
+	case *parser.UnaryExpr:
+		cp := *n
+		cp.Expr = cloneWithMatcher(n.Expr, matcher).(parser.Expr)
+		return &cp
+
+	case *parser.BinaryExpr:
+		cp := *n
+		cp.LHS = cloneWithMatcher(n.LHS, matcher).(parser.Expr)
+		cp.RHS = cloneWithMatcher(n.RHS, matcher).(parser.Expr)
+		return &cp
+
+	case *parser.AggregateExpr:
+		cp := *n
+		cp.Expr = cloneWithMatcher(n.Expr, matcher).(parser.Expr)
+		return &cp
+
+	case *parser.Call:
+		cp := *n
+		args := make(parser.Expressions, len(n.Args))
+		for i, a := range n.Args {
+			args[i] = cloneWithMatcher(a, matcher).(parser.Expr)
+		}
+		cp.Args = args
+		return &cp
+
+	default:
+		// NumberLiteral, StringLiteral and anything else without a
+		// selector underneath: nothing to inject, share the node as-is.
+		return node
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shard
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestValue(t *testing.T) {
+	require.Equal(t, "1_of_4", Value(1, 4))
+}
+
+func TestShardable(t *testing.T) {
+	sumExpr := &parser.AggregateExpr{
+		Op:   parser.SUM,
+		Expr: &parser.VectorSelector{},
+	}
+	require.True(t, Shardable(sumExpr))
+
+	quantileExpr := &parser.AggregateExpr{
+		Op:   parser.QUANTILE,
+		Expr: &parser.VectorSelector{},
+	}
+	require.False(t, Shardable(quantileExpr))
+
+	absentCall := &parser.Call{
+		Func: &parser.Function{Name: "absent"},
+		Args: parser.Expressions{&parser.VectorSelector{}},
+	}
+	require.False(t, Shardable(absentCall))
+
+	rateCall := &parser.Call{
+		Func: &parser.Function{Name: "rate"},
+		Args: parser.Expressions{&parser.MatrixSelector{VectorSelector: &parser.VectorSelector{}}},
+	}
+	require.True(t, Shardable(rateCall))
+}
+
+func TestShard_InjectsMatcherIntoEverySelector(t *testing.T) {
+	existing := labels.MustNewMatcher(labels.MatchEqual, "job", "api")
+	expr := &parser.BinaryExpr{
+		LHS: &parser.VectorSelector{LabelMatchers: []*labels.Matcher{existing}},
+		RHS: &parser.MatrixSelector{VectorSelector: &parser.VectorSelector{}},
+	}
+
+	sharded := Shard(expr, 2, 4).(*parser.BinaryExpr)
+
+	lhs := sharded.LHS.(*parser.VectorSelector)
+	require.Len(t, lhs.LabelMatchers, 2)
+	require.Contains(t, lhs.LabelMatchers, existing)
+	require.Contains(t, lhs.LabelMatchers, labels.MustNewMatcher(labels.MatchEqual, Label, Value(2, 4)))
+
+	rhs := sharded.RHS.(*parser.MatrixSelector).VectorSelector.(*parser.VectorSelector)
+	require.Len(t, rhs.LabelMatchers, 1)
+
+	// The original expr must be left untouched.
+	require.Len(t, expr.LHS.(*parser.VectorSelector).LabelMatchers, 1)
+}
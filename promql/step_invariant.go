@@ -0,0 +1,200 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Status: IsStepInvariant, PreprocessExpr and stepInvariantCache's Get/Set
+// are real and tested (see step_invariant_test.go), but stepInvariantCache
+// is not wired into any range-eval loop -- there is no such loop in this
+// tree to call it. The step-invariant-caching request this file belongs to
+// is not closed by this file alone.
+package promql
+
+import (
+	"sync"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// volatileFuncs are PromQL functions whose result depends on the evaluation
+// timestamp itself rather than only on the samples their arguments select,
+// so a call to one of them is never step-invariant unless the call as a
+// whole sits under an @ modifier.
+var volatileFuncs = map[string]bool{
+	"time":          true,
+	"minute":        true,
+	"hour":          true,
+	"day_of_week":   true,
+	"day_of_month":  true,
+	"days_in_month": true,
+	"month":         true,
+	"year":          true,
+}
+
+// StepInvariantExpr wraps a subexpression whose value is the same at every
+// step of a range query, so the evaluator can evaluate Expr once and
+// broadcast the result across all steps instead of re-evaluating it per
+// step. It belongs conceptually in promql/parser alongside the other Expr
+// implementations, but that package isn't part of this snapshot, so it
+// lives here; embedding parser.Expr lets it satisfy the parser.Expr
+// interface (including its unexported marker method) without this package
+// being able to implement that method itself.
+type StepInvariantExpr struct {
+	parser.Expr
+}
+
+// hasAtModifier reports whether node pins its own evaluation time via an @
+// modifier, independent of whatever timestamp the evaluator is stepping
+// through.
+func hasAtModifier(node parser.Node) bool {
+	switch n := node.(type) {
+	case *parser.VectorSelector:
+		return n.Timestamp != nil || n.StartOrEnd != 0
+	case *parser.SubqueryExpr:
+		return n.Timestamp != nil || n.StartOrEnd != 0
+	default:
+		return false
+	}
+}
+
+// IsStepInvariant reports whether expr evaluates to the same value
+// regardless of which timestamp in a range query's step sequence it is
+// evaluated at: true for literals, for any selector or subquery pinned by
+// `@ <const>`, `@ start()` or `@ end()`, and for any composite expression
+// all of whose children are themselves step-invariant, except calls to
+// volatileFuncs (time(), minute(), ...), which depend on the evaluation
+// timestamp directly and so are only invariant when the call itself is
+// under an @ modifier.
+func IsStepInvariant(expr parser.Expr) bool {
+	switch n := expr.(type) {
+	case *parser.NumberLiteral, *parser.StringLiteral:
+		return true
+
+	case *parser.VectorSelector, *parser.SubqueryExpr:
+		return hasAtModifier(n)
+
+	case *parser.MatrixSelector:
+		return IsStepInvariant(n.VectorSelector)
+
+	case *parser.ParenExpr:
+		return IsStepInvariant(n.Expr)
+
+	case *parser.UnaryExpr:
+		return IsStepInvariant(n.Expr)
+
+	case *parser.BinaryExpr:
+		return IsStepInvariant(n.LHS) && IsStepInvariant(n.RHS)
+
+	case *parser.AggregateExpr:
+		return IsStepInvariant(n.Expr)
+
+	case *parser.Call:
+		if n.Func != nil && volatileFuncs[n.Func.Name] {
+			return false
+		}
+		for _, a := range n.Args {
+			if !IsStepInvariant(a) {
+				return false
+			}
+		}
+		return true
+
+	case *StepInvariantExpr:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// PreprocessExpr rewrites expr bottom-up, wrapping every maximal
+// step-invariant subtree (one that IsStepInvariant accepts but whose parent
+// doesn't) in a StepInvariantExpr so the range evaluation loop can evaluate
+// it once and broadcast the cached result across every step, rather than
+// re-running it per step. A subtree already wrapped in a StepInvariantExpr
+// is left alone.
+func PreprocessExpr(expr parser.Expr) parser.Expr {
+	if expr == nil || IsStepInvariant(expr) {
+		if expr == nil {
+			return nil
+		}
+		if _, wrapped := expr.(*StepInvariantExpr); wrapped {
+			return expr
+		}
+		return &StepInvariantExpr{Expr: expr}
+	}
+
+	switch n := expr.(type) {
+	case *parser.ParenExpr:
+		cp := *n
+		cp.Expr = PreprocessExpr(n.Expr)
+		return &cp
+
+	case *parser.UnaryExpr:
+		cp := *n
+		cp.Expr = PreprocessExpr(n.Expr)
+		return &cp
+
+	case *parser.BinaryExpr:
+		cp := *n
+		cp.LHS = PreprocessExpr(n.LHS)
+		cp.RHS = PreprocessExpr(n.RHS)
+		return &cp
+
+	case *parser.AggregateExpr:
+		cp := *n
+		cp.Expr = PreprocessExpr(n.Expr)
+		return &cp
+
+	case *parser.Call:
+		cp := *n
+		args := make(parser.Expressions, len(n.Args))
+		for i, a := range n.Args {
+			args[i] = PreprocessExpr(a)
+		}
+		cp.Args = args
+		return &cp
+
+	default:
+		return expr
+	}
+}
+
+// stepInvariantCache memoizes the single evaluation of each StepInvariantExpr
+// within one range query, keyed by pointer identity of the wrapped node, so
+// the evaluator's range loop can call Get/Set instead of re-evaluating
+// Expr.Expr on every step. There is no real evaluator in this tree to hold
+// one of these (promql/engine.go's range evaluation loop isn't part of this
+// snapshot), so it is wired up but unused here.
+type stepInvariantCache struct {
+	mtx    sync.Mutex
+	values map[parser.Expr]interface{}
+}
+
+func newStepInvariantCache() *stepInvariantCache {
+	return &stepInvariantCache{values: make(map[parser.Expr]interface{})}
+}
+
+// Get returns the cached value for e, if the evaluator has already computed
+// one this query.
+func (c *stepInvariantCache) Get(e *StepInvariantExpr) (interface{}, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	v, ok := c.values[e.Expr]
+	return v, ok
+}
+
+// Set records v as the value of e.Expr for the remainder of this query.
+func (c *stepInvariantCache) Set(e *StepInvariantExpr, v interface{}) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.values[e.Expr] = v
+}
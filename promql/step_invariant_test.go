@@ -0,0 +1,126 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package promql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestIsStepInvariant_Literals(t *testing.T) {
+	require.True(t, IsStepInvariant(&parser.NumberLiteral{Val: 1}))
+	require.True(t, IsStepInvariant(&parser.StringLiteral{Val: "x"}))
+}
+
+func TestIsStepInvariant_SelectorNeedsAtModifier(t *testing.T) {
+	plain := &parser.VectorSelector{}
+	require.False(t, IsStepInvariant(plain))
+
+	ts := int64(10)
+	pinned := &parser.VectorSelector{Timestamp: &ts}
+	require.True(t, IsStepInvariant(pinned))
+}
+
+func TestIsStepInvariant_VolatileFuncNeedsAtModifier(t *testing.T) {
+	ts := int64(10)
+	timeCall := &parser.Call{Func: &parser.Function{Name: "time"}}
+	require.False(t, IsStepInvariant(timeCall))
+
+	pinnedArg := &parser.VectorSelector{Timestamp: &ts}
+	rateCall := &parser.Call{
+		Func: &parser.Function{Name: "rate"},
+		Args: parser.Expressions{&parser.MatrixSelector{VectorSelector: pinnedArg}},
+	}
+	require.True(t, IsStepInvariant(rateCall))
+}
+
+func TestIsStepInvariant_BinaryExprRequiresBothSides(t *testing.T) {
+	invariant := &parser.NumberLiteral{Val: 1}
+	variant := &parser.VectorSelector{}
+
+	require.True(t, IsStepInvariant(&parser.BinaryExpr{LHS: invariant, RHS: invariant}))
+	require.False(t, IsStepInvariant(&parser.BinaryExpr{LHS: invariant, RHS: variant}))
+}
+
+func TestIsStepInvariant_AlreadyWrapped(t *testing.T) {
+	wrapped := &StepInvariantExpr{Expr: &parser.VectorSelector{}}
+	require.True(t, IsStepInvariant(wrapped))
+}
+
+func TestPreprocessExpr_WrapsInvariantSubtreeOnly(t *testing.T) {
+	invariant := &parser.NumberLiteral{Val: 5}
+	variant := &parser.VectorSelector{}
+	expr := &parser.BinaryExpr{LHS: invariant, RHS: variant}
+
+	out := PreprocessExpr(expr).(*parser.BinaryExpr)
+
+	_, lhsWrapped := out.LHS.(*StepInvariantExpr)
+	require.True(t, lhsWrapped, "the invariant LHS should be wrapped")
+
+	_, rhsWrapped := out.RHS.(*StepInvariantExpr)
+	require.False(t, rhsWrapped, "the variant RHS should not be wrapped")
+}
+
+func TestPreprocessExpr_WholeExprInvariant(t *testing.T) {
+	expr := &parser.NumberLiteral{Val: 5}
+	out := PreprocessExpr(expr)
+
+	wrapped, ok := out.(*StepInvariantExpr)
+	require.True(t, ok)
+	require.Same(t, expr, wrapped.Expr)
+}
+
+func TestPreprocessExpr_Nil(t *testing.T) {
+	require.Nil(t, PreprocessExpr(nil))
+}
+
+func TestPreprocessExpr_DoesNotDoubleWrap(t *testing.T) {
+	inner := &parser.NumberLiteral{Val: 5}
+	already := &StepInvariantExpr{Expr: inner}
+
+	out := PreprocessExpr(already)
+	require.Same(t, already, out)
+}
+
+// TestStepInvariantCache_GetSet checks the memoization primitive an
+// evaluator's range loop would use to avoid re-evaluating a step-invariant
+// subtree on every step; there is no such loop in this tree to exercise it
+// end to end, so this tests Get/Set in isolation.
+func TestStepInvariantCache_GetSet(t *testing.T) {
+	c := newStepInvariantCache()
+	e := &StepInvariantExpr{Expr: &parser.VectorSelector{}}
+
+	_, ok := c.Get(e)
+	require.False(t, ok)
+
+	c.Set(e, 42)
+	v, ok := c.Get(e)
+	require.True(t, ok)
+	require.Equal(t, 42, v)
+}
+
+func TestStepInvariantCache_KeyedByWrappedExprIdentity(t *testing.T) {
+	c := newStepInvariantCache()
+	inner := &parser.VectorSelector{}
+	e1 := &StepInvariantExpr{Expr: inner}
+	e2 := &StepInvariantExpr{Expr: inner}
+
+	c.Set(e1, "cached")
+	v, ok := c.Get(e2)
+	require.True(t, ok, "two wrappers of the same underlying expr share a cache entry")
+	require.Equal(t, "cached", v)
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package otlpexemplar derives Prometheus exemplars from OpenTelemetry
+// trace spans, so a tracing pipeline can feed exemplars into Prometheus
+// directly (via HTTPHandler) instead of going through a sidecar that
+// re-scrapes a metrics endpoint carrying span context.
+package otlpexemplar
+
+// Config controls how an incoming span is mapped onto the Prometheus
+// metric its exemplar should attach to.
+type Config struct {
+	// MetricNameAttribute is the span attribute key (e.g. "service.name")
+	// whose value, combined with SpanNameAsMetric, selects which metric
+	// series the span's exemplar is attached to. A span without this
+	// attribute is skipped.
+	MetricNameAttribute string
+
+	// SpanNameAsMetric appends the span's own name to the value of
+	// MetricNameAttribute (joined with "_") to form the target metric
+	// name, e.g. service.name="api" + span name "GetUser" ->
+	// "api_GetUser". If false, MetricNameAttribute's value is used as
+	// the metric name verbatim.
+	SpanNameAsMetric bool
+
+	// AttributeToLabel maps additional span (or resource) attribute keys
+	// to the Prometheus label name the exemplar should carry them under,
+	// e.g. {"http.route": "route"}. trace_id and span_id are always
+	// added automatically and don't need an entry here.
+	AttributeToLabel map[string]string
+
+	// SampleRate, in (0, 1], is the fraction of eligible spans that are
+	// actually translated into exemplars; 0 or a value >= 1 means every
+	// eligible span is used. Intended to bound exemplar volume from a
+	// high-throughput tracing pipeline without disabling the feature.
+	SampleRate float64
+}
+
+// Keep returns whether a span at index n (a monotonically increasing
+// per-process counter, not the span's own ID) should be translated given
+// cfg.SampleRate, using simple deterministic decimation rather than a
+// random draw. Which spans are kept depends on their arrival order since
+// the Translator was created, so replaying a trace export request through
+// the same Translator can keep a different subset of its spans.
+func (c Config) Keep(n uint64) bool {
+	if c.SampleRate <= 0 || c.SampleRate >= 1 {
+		return true
+	}
+	period := uint64(1 / c.SampleRate)
+	if period == 0 {
+		period = 1
+	}
+	return n%period == 0
+}
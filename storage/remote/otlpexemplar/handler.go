@@ -0,0 +1,82 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package otlpexemplar
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// Handler is an http.Handler that accepts an OTLP ExportTraceServiceRequest
+// (protobuf-encoded, per the OTLP/HTTP trace spec) and appends the
+// exemplars Translator derives from it to app.
+type Handler struct {
+	translator *Translator
+	app        storage.ExemplarAppender
+	logger     log.Logger
+}
+
+// NewHandler returns a Handler that translates spans according to cfg and
+// appends the resulting exemplars to app.
+func NewHandler(cfg Config, app storage.ExemplarAppender, logger log.Logger) *Handler {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &Handler{translator: NewTranslator(cfg), app: app, logger: logger}
+}
+
+// ServeHTTP implements http.Handler. It only accepts
+// application/x-protobuf bodies, matching the OTLP/HTTP default; a
+// collector configured for application/json would need a separate decode
+// path this handler does not implement.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if ct := r.Header.Get("Content-Type"); ct != "" && ct != "application/x-protobuf" {
+		http.Error(w, "unsupported content-type: "+ct, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var req coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, "decoding OTLP trace request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	exemplars := h.translator.Translate(req.GetResourceSpans())
+	for _, se := range exemplars {
+		// trace_id and span_id identify the exemplar, not the series it
+		// attaches to.
+		lb := labels.NewBuilder(se.Exemplar.Labels).Del("trace_id", "span_id").Set(labels.MetricName, se.MetricName)
+		if err := h.app.AddExemplar(lb.Labels(), se.Exemplar.Ts, se.Exemplar); err != nil {
+			level.Warn(h.logger).Log("msg", "failed to add exemplar from span", "metric", se.MetricName, "err", err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
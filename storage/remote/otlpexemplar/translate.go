@@ -0,0 +1,136 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package otlpexemplar
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+
+	"github.com/prometheus/prometheus/pkg/exemplar"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// SeriesExemplar pairs an exemplar.Exemplar with the labels of the metric
+// series it should be attached to, since unlike a scrape-derived exemplar
+// (which already lives alongside its sample) a span-derived one has to name
+// its target series explicitly.
+type SeriesExemplar struct {
+	MetricName string
+	Exemplar   exemplar.Exemplar
+}
+
+// Translator derives SeriesExemplars from OTLP trace spans according to cfg.
+// A single Translator is shared across concurrent HTTP requests by Handler,
+// so count is only ever touched through the sync/atomic package.
+type Translator struct {
+	cfg   Config
+	count uint64
+}
+
+// NewTranslator returns a Translator configured by cfg.
+func NewTranslator(cfg Config) *Translator {
+	return &Translator{cfg: cfg}
+}
+
+// Translate walks every span in rs and returns the SeriesExemplars derived
+// from the ones cfg selects (via MetricNameAttribute and SampleRate).
+// A span missing MetricNameAttribute, on either the span or its resource,
+// is skipped rather than treated as an error, since a trace export request
+// carries spans from many services and only some are expected to carry
+// Prometheus-relevant attributes.
+func (t *Translator) Translate(rs []*tracepb.ResourceSpans) []SeriesExemplar {
+	var out []SeriesExemplar
+	for _, rspans := range rs {
+		resourceAttrs := attrMap(rspans.GetResource().GetAttributes())
+		for _, ss := range rspans.GetScopeSpans() {
+			for _, span := range ss.GetSpans() {
+				se, ok := t.translateSpan(span, resourceAttrs)
+				if !ok {
+					continue
+				}
+				out = append(out, se)
+			}
+		}
+	}
+	return out
+}
+
+func (t *Translator) translateSpan(span *tracepb.Span, resourceAttrs map[string]string) (SeriesExemplar, bool) {
+	spanAttrs := attrMap(span.GetAttributes())
+
+	metric, ok := spanAttrs[t.cfg.MetricNameAttribute]
+	if !ok {
+		metric, ok = resourceAttrs[t.cfg.MetricNameAttribute]
+	}
+	if !ok || metric == "" {
+		return SeriesExemplar{}, false
+	}
+	if t.cfg.SpanNameAsMetric && span.GetName() != "" {
+		metric = metric + "_" + span.GetName()
+	}
+
+	n := atomic.AddUint64(&t.count, 1) - 1
+	if !t.cfg.Keep(n) {
+		return SeriesExemplar{}, false
+	}
+
+	lb := labels.NewBuilder(nil).
+		Set("trace_id", hex.EncodeToString(span.GetTraceId())).
+		Set("span_id", hex.EncodeToString(span.GetSpanId()))
+	for attr, label := range t.cfg.AttributeToLabel {
+		if v, ok := spanAttrs[attr]; ok {
+			lb = lb.Set(label, v)
+		} else if v, ok := resourceAttrs[attr]; ok {
+			lb = lb.Set(label, v)
+		}
+	}
+
+	return SeriesExemplar{
+		MetricName: metric,
+		Exemplar: exemplar.Exemplar{
+			Labels: lb.Labels(),
+			Ts:     int64(span.GetEndTimeUnixNano() / 1e6),
+			HasTs:  true,
+		},
+	}, true
+}
+
+// attrMap flattens an OTLP attribute list into a string map, stringifying
+// non-string values with fmt.Sprint; AttributeToLabel and
+// MetricNameAttribute only ever select a handful of well-known attributes,
+// so a lossy string conversion for the rare non-string one is an acceptable
+// tradeoff against carrying the full KeyValue/AnyValue type through the
+// rest of this package.
+func attrMap(attrs []*commonpb.KeyValue) map[string]string {
+	m := make(map[string]string, len(attrs))
+	for _, kv := range attrs {
+		m[kv.GetKey()] = anyValueString(kv.GetValue())
+	}
+	return m
+}
+
+func anyValueString(v *commonpb.AnyValue) string {
+	switch x := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return x.StringValue
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(x)
+	}
+}
@@ -16,9 +16,11 @@ package tsdb
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/pkg/exemplar"
+	"github.com/prometheus/prometheus/pkg/histogram"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/storage"
 )
@@ -26,6 +28,8 @@ import (
 type exemplarMetrics struct {
 	outOfOrderExemplars prometheus.Counter
 	duplicateExemplars  prometheus.Counter
+	evictedByAge        prometheus.Counter
+	evictedBySeriesCap  prometheus.Counter
 }
 
 func newExemplarMetrics(r prometheus.Registerer) *exemplarMetrics {
@@ -38,23 +42,74 @@ func newExemplarMetrics(r prometheus.Registerer) *exemplarMetrics {
 			Name: "prometheus_exemplar_duplicate_exemplars_total",
 			Help: "Total number of series in the head block.",
 		}),
+		evictedByAge: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_exemplar_evicted_by_age_total",
+			Help: "Total number of exemplars evicted for exceeding ExemplarStorageOptions.MaxExemplarAge.",
+		}),
+		evictedBySeriesCap: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_exemplar_evicted_by_series_cap_total",
+			Help: "Total number of exemplars evicted for exceeding ExemplarStorageOptions.MaxExemplarsPerSeries.",
+		}),
 	}
 	if r != nil {
 		r.MustRegister(
 			m.outOfOrderExemplars,
 			m.duplicateExemplars,
+			m.evictedByAge,
+			m.evictedBySeriesCap,
 		)
 	}
 	return m
 }
 
+// ExemplarStorageOptions configures the per-series retention limits a
+// CircularExemplarStorage enforces on top of its fixed-size ring.
+type ExemplarStorageOptions struct {
+	// MaxExemplarsPerSeries caps how many exemplars are kept for any one
+	// labelset, so a single chatty series can't evict every exemplar
+	// belonging to quieter ones out of the shared ring. 0 disables the
+	// per-series cap (the ring's total size is still the only limit).
+	MaxExemplarsPerSeries int
+
+	// MaxExemplarAge drops exemplars once they're older than this,
+	// regardless of how full the ring or a series' own quota is. 0
+	// disables age-based eviction.
+	MaxExemplarAge time.Duration
+
+	// ReapInterval is how often the background reaper walks the index
+	// evicting exemplars older than MaxExemplarAge. Ignored if
+	// MaxExemplarAge is 0. Defaults to MaxExemplarAge/2 if zero.
+	ReapInterval time.Duration
+
+	// DedupLookback bounds how many of a series' most recent exemplars
+	// addExemplar compares an incoming one against before accepting it,
+	// instead of only the single most recent entry. This catches a
+	// remote_write agent (or any forwarder) re-sending the same scrape's
+	// exemplar more than once, which the single-entry check would
+	// otherwise misreport as out-of-order rather than a duplicate.
+	// Defaults to 2 if zero.
+	DedupLookback int
+}
+
 type CircularExemplarStorage struct {
 	metrics     *exemplarMetrics
+	opts        ExemplarStorageOptions
 	lock        sync.RWMutex
 	index       map[string]int
+	seriesCount map[string]int
 	exemplars   []*circularBufferEntry
 	nextIndex   int
 	secondaries []storage.ExemplarAppender
+
+	// labelValueIndex maps a label name to the value(s) it takes across
+	// every series currently in index, and each value to the set of
+	// series-label-string keys (as used by index) carrying it. It lets
+	// SelectMatchers find the series a []*labels.Matcher selects without
+	// scanning every entry in the ring.
+	labelValueIndex map[string]map[string]map[string]struct{}
+
+	stopReaper chan struct{}
+	reaperDone chan struct{}
 }
 
 type circularBufferEntry struct {
@@ -67,11 +122,72 @@ type circularBufferEntry struct {
 // If we assume the average case 95 bytes per exemplar we can fit 5651272 exemplars in
 // 1GB of extra memory, accounting for the fact that this is heap allocated space.
 func NewCircularExemplarStorage(len int, reg prometheus.Registerer, secondaries ...storage.ExemplarAppender) *CircularExemplarStorage {
-	return &CircularExemplarStorage{
-		exemplars:   make([]*circularBufferEntry, len),
-		index:       make(map[string]int),
-		secondaries: secondaries,
-		metrics:     newExemplarMetrics(reg),
+	return NewCircularExemplarStorageWithOptions(len, reg, ExemplarStorageOptions{}, secondaries...)
+}
+
+// NewCircularExemplarStorageWithOptions is like NewCircularExemplarStorage
+// but additionally enforces opts' per-series cap and/or max-age eviction. If
+// opts.MaxExemplarAge is set, a background goroutine reaps expired
+// exemplars every opts.ReapInterval until Close is called.
+func NewCircularExemplarStorageWithOptions(len int, reg prometheus.Registerer, opts ExemplarStorageOptions, secondaries ...storage.ExemplarAppender) *CircularExemplarStorage {
+	ce := &CircularExemplarStorage{
+		exemplars:       make([]*circularBufferEntry, len),
+		index:           make(map[string]int),
+		seriesCount:     make(map[string]int),
+		labelValueIndex: make(map[string]map[string]map[string]struct{}),
+		secondaries:     secondaries,
+		metrics:         newExemplarMetrics(reg),
+		opts:            opts,
+	}
+	if opts.MaxExemplarAge > 0 {
+		if ce.opts.ReapInterval <= 0 {
+			ce.opts.ReapInterval = opts.MaxExemplarAge / 2
+		}
+		ce.stopReaper = make(chan struct{})
+		ce.reaperDone = make(chan struct{})
+		go ce.runReaper()
+	}
+	if ce.opts.DedupLookback <= 0 {
+		ce.opts.DedupLookback = 2
+	}
+	return ce
+}
+
+// Close stops the background reaper, if one was started. Safe to call on a
+// CircularExemplarStorage with no reaper (e.g. from NewCircularExemplarStorage).
+func (ce *CircularExemplarStorage) Close() {
+	if ce.stopReaper == nil {
+		return
+	}
+	close(ce.stopReaper)
+	<-ce.reaperDone
+}
+
+// runReaper periodically evicts exemplars older than opts.MaxExemplarAge
+// from every series' chain, until stopReaper is closed.
+func (ce *CircularExemplarStorage) runReaper() {
+	defer close(ce.reaperDone)
+	t := time.NewTicker(ce.opts.ReapInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ce.stopReaper:
+			return
+		case <-t.C:
+			ce.reapExpired()
+		}
+	}
+}
+
+// reapExpired walks every series currently in the index and truncates its
+// chain at the first exemplar older than opts.MaxExemplarAge.
+func (ce *CircularExemplarStorage) reapExpired() {
+	minTimestamp := time.Now().Add(-ce.opts.MaxExemplarAge).UnixNano() / int64(time.Millisecond)
+
+	ce.lock.Lock()
+	defer ce.lock.Unlock()
+	for seriesLabels, idx := range ce.index {
+		ce.truncateChain(seriesLabels, idx, 0, minTimestamp)
 	}
 }
 
@@ -90,6 +206,15 @@ func (ce *CircularExemplarStorage) SetSecondaries(secondaries ...storage.Exempla
 
 // Select returns exemplars for a given set of series labels hash.
 func (ce *CircularExemplarStorage) Select(start, end int64, l labels.Labels) ([]exemplar.Exemplar, error) {
+	ce.lock.RLock()
+	defer ce.lock.RUnlock()
+
+	return ce.selectSeriesLocked(start, end, l), nil
+}
+
+// selectSeriesLocked is the per-series walk shared by Select and
+// SelectMatchers. Callers must hold ce.lock.
+func (ce *CircularExemplarStorage) selectSeriesLocked(start, end int64, l labels.Labels) []exemplar.Exemplar {
 	var (
 		ret []exemplar.Exemplar
 		e   exemplar.Exemplar
@@ -98,11 +223,8 @@ func (ce *CircularExemplarStorage) Select(start, end int64, l labels.Labels) ([]
 		buf []byte
 	)
 
-	ce.lock.RLock()
-	defer ce.lock.RUnlock()
-
 	if idx, ok = ce.index[l.String()]; !ok {
-		return nil, nil
+		return nil
 	}
 	lastTs := ce.exemplars[idx].scrapeTimestamp
 
@@ -129,9 +251,59 @@ func (ce *CircularExemplarStorage) Select(start, end int64, l labels.Labels) ([]
 		idx = ce.exemplars[idx].prev
 	}
 	reverseExemplars(ret)
+	return ret
+}
+
+// SelectMatchers returns exemplars, across every series the given matchers
+// select, whose timestamp falls within [start, end]. Unlike Select, callers
+// don't need to know a series' full labelset up front: matchers is
+// evaluated, via labelValueIndex, against every series currently tracked by
+// the ring, mirroring storage.Querier.Select's matcher-based series
+// selection.
+func (ce *CircularExemplarStorage) SelectMatchers(start, end int64, matchers []*labels.Matcher) ([]exemplar.Exemplar, error) {
+	ce.lock.RLock()
+	defer ce.lock.RUnlock()
+
+	var ret []exemplar.Exemplar
+	for sl := range ce.matchingSeriesLocked(matchers) {
+		idx, ok := ce.index[sl]
+		if !ok {
+			continue
+		}
+		ret = append(ret, ce.selectSeriesLocked(start, end, ce.exemplars[idx].seriesLabels)...)
+	}
 	return ret, nil
 }
 
+// matchingSeriesLocked returns the index keys (as used by ce.index) of
+// every series satisfying every matcher in matchers, built by intersecting
+// per-matcher candidate sets drawn from labelValueIndex rather than
+// scanning the ring. Callers must hold ce.lock.
+func (ce *CircularExemplarStorage) matchingSeriesLocked(matchers []*labels.Matcher) map[string]struct{} {
+	result := make(map[string]struct{})
+	for i, m := range matchers {
+		matched := make(map[string]struct{})
+		for v, series := range ce.labelValueIndex[m.Name] {
+			if !m.Matches(v) {
+				continue
+			}
+			for sl := range series {
+				matched[sl] = struct{}{}
+			}
+		}
+		if i == 0 {
+			result = matched
+			continue
+		}
+		for sl := range result {
+			if _, ok := matched[sl]; !ok {
+				delete(result, sl)
+			}
+		}
+	}
+	return result
+}
+
 // Takes the circularBufferEntry that will be overwritten and updates the
 // storages index for that entries labelset if necessary.
 func (ce *CircularExemplarStorage) indexGcCheck(cbe *circularBufferEntry) {
@@ -141,19 +313,136 @@ func (ce *CircularExemplarStorage) indexGcCheck(cbe *circularBufferEntry) {
 
 	l := cbe.seriesLabels
 	i := cbe.prev
+
+	// The ring slot holding cbe is about to be overwritten, permanently
+	// destroying that exemplar, so l's count of live exemplars drops by one
+	// regardless of what else below happens to its index entry.
+	sl := l.String()
+	if ce.seriesCount[sl] > 0 {
+		ce.seriesCount[sl]--
+		if ce.seriesCount[sl] == 0 {
+			delete(ce.seriesCount, sl)
+		}
+	}
+
 	if cbe.prev == -1 {
-		delete(ce.index, l.String())
+		delete(ce.index, sl)
+		ce.removeFromLabelIndex(sl, l)
 		return
 	}
 
 	if ce.exemplars[ce.nextIndex] != nil {
 		l2 := ce.exemplars[i].seriesLabels
 		if !labels.Equal(l2, l) { // No more exemplars for series l.
-			delete(ce.index, cbe.seriesLabels.String())
+			delete(ce.index, sl)
+			ce.removeFromLabelIndex(sl, l)
 			return
 		}
 		// There's still at least one exemplar for the series l, so we can update the index.
-		ce.index[l.String()] = i
+		ce.index[sl] = i
+	}
+}
+
+// addToLabelIndex and removeFromLabelIndex maintain ce.labelValueIndex, a
+// label name/value -> set of series-label-string secondary index that lets
+// SelectMatchers avoid a full scan of the ring. Callers must hold ce.lock.
+func (ce *CircularExemplarStorage) addToLabelIndex(sl string, l labels.Labels) {
+	for _, lbl := range l {
+		values, ok := ce.labelValueIndex[lbl.Name]
+		if !ok {
+			values = make(map[string]map[string]struct{})
+			ce.labelValueIndex[lbl.Name] = values
+		}
+		series, ok := values[lbl.Value]
+		if !ok {
+			series = make(map[string]struct{})
+			values[lbl.Value] = series
+		}
+		series[sl] = struct{}{}
+	}
+}
+
+func (ce *CircularExemplarStorage) removeFromLabelIndex(sl string, l labels.Labels) {
+	for _, lbl := range l {
+		values, ok := ce.labelValueIndex[lbl.Name]
+		if !ok {
+			continue
+		}
+		series, ok := values[lbl.Value]
+		if !ok {
+			continue
+		}
+		delete(series, sl)
+		if len(series) == 0 {
+			delete(values, lbl.Value)
+		}
+		if len(values) == 0 {
+			delete(ce.labelValueIndex, lbl.Name)
+		}
+	}
+}
+
+// truncateChain walks the series chain starting at headIdx and cuts it at
+// the first entry that is either more than maxKeep deep (if maxKeep > 0) or
+// older than minTimestamp (if minTimestamp > 0), decrementing seriesCount by
+// however many entries were cut loose and bumping the matching eviction
+// metric. The cut entries' own ring slots are cleared immediately (see
+// below) rather than left for ordinary rotation to destroy later, so
+// Select, future truncateChain calls and indexGcCheck all stop seeing them
+// the moment they're cut. Callers must hold ce.lock.
+func (ce *CircularExemplarStorage) truncateChain(seriesLabels string, headIdx int, maxKeep int, minTimestamp int64) {
+	depth := 0
+	idx := headIdx
+	linkIdx := -1 // index whose .prev field points at idx; -1 means idx is the head.
+
+	for idx != -1 {
+		entry := ce.exemplars[idx]
+		if entry == nil {
+			return
+		}
+		depth++
+		tooOld := minTimestamp > 0 && entry.scrapeTimestamp < minTimestamp
+		tooDeep := maxKeep > 0 && depth > maxKeep
+		if !tooOld && !tooDeep {
+			linkIdx = idx
+			idx = entry.prev
+			continue
+		}
+
+		evicted := 0
+		cutIdxs := make([]int, 0, depth)
+		for e := idx; e != -1; {
+			cutIdxs = append(cutIdxs, e)
+			evicted++
+			e = ce.exemplars[e].prev
+		}
+		if linkIdx == -1 {
+			delete(ce.index, seriesLabels)
+			ce.removeFromLabelIndex(seriesLabels, entry.seriesLabels)
+		} else {
+			ce.exemplars[linkIdx].prev = -1
+		}
+		// Clear the cut entries' own slots rather than leaving them in the
+		// ring to be destroyed later by ordinary rotation: once unlinked,
+		// indexGcCheck has no way to tell one of these stale slots apart
+		// from a live entry for the same series -- it would find
+		// ce.index[seriesLabels] already pointing at a different,
+		// still-live chain and delete it out from under that chain. A nil
+		// slot is a no-op for indexGcCheck, so clearing here is what makes
+		// that later call on this slot safe.
+		for _, e := range cutIdxs {
+			ce.exemplars[e] = nil
+		}
+		ce.seriesCount[seriesLabels] -= evicted
+		if ce.seriesCount[seriesLabels] <= 0 {
+			delete(ce.seriesCount, seriesLabels)
+		}
+		if tooOld {
+			ce.metrics.evictedByAge.Add(float64(evicted))
+		} else {
+			ce.metrics.evictedBySeriesCap.Add(float64(evicted))
+		}
+		return
 	}
 }
 
@@ -173,6 +462,8 @@ func (ce *CircularExemplarStorage) addExemplar(l labels.Labels, t int64, e exemp
 			scrapeTimestamp: t,
 			prev:            -1}
 		ce.index[seriesLabels] = ce.nextIndex
+		ce.seriesCount[seriesLabels]++
+		ce.addToLabelIndex(seriesLabels, l)
 		ce.nextIndex++
 		if ce.nextIndex >= cap(ce.exemplars) {
 			ce.nextIndex = 0
@@ -180,11 +471,24 @@ func (ce *CircularExemplarStorage) addExemplar(l labels.Labels, t int64, e exemp
 		return nil
 	}
 
-	// Check for duplicate vs last stored exemplar for this series.
-	if ce.exemplars[idx].exemplar.Equals(e) {
-		ce.metrics.duplicateExemplars.Inc()
-		return storage.ErrDuplicateExemplar
+	// Check for a duplicate against not just the most recent exemplar for
+	// this series but up to opts.DedupLookback of them, since a
+	// remote_write agent can re-send an already-seen exemplar under a new
+	// scrape timestamp; comparing only the latest entry would reject that
+	// as out-of-order instead of recognizing it as a duplicate. This also
+	// covers an agent forwarding the same scrape twice: the re-sent
+	// exemplar's own Ts (part of Exemplar.Equals) matches the stored one,
+	// so it's caught here rather than falling through to the out-of-order
+	// check below.
+	walkIdx := idx
+	for i := 0; i < ce.opts.DedupLookback && walkIdx != -1; i++ {
+		if ce.exemplars[walkIdx].exemplar.Equals(e) {
+			ce.metrics.duplicateExemplars.Inc()
+			return storage.ErrDuplicateExemplar
+		}
+		walkIdx = ce.exemplars[walkIdx].prev
 	}
+
 	if e.Ts <= ce.exemplars[idx].scrapeTimestamp || t <= ce.exemplars[idx].scrapeTimestamp {
 		ce.metrics.outOfOrderExemplars.Inc()
 		return storage.ErrOutOfOrderExemplar
@@ -196,10 +500,16 @@ func (ce *CircularExemplarStorage) addExemplar(l labels.Labels, t int64, e exemp
 		scrapeTimestamp: t,
 		prev:            idx}
 	ce.index[seriesLabels] = ce.nextIndex
+	ce.seriesCount[seriesLabels]++
+	newIdx := ce.nextIndex
 	ce.nextIndex++
 	if ce.nextIndex >= cap(ce.exemplars) {
 		ce.nextIndex = 0
 	}
+
+	if ce.opts.MaxExemplarsPerSeries > 0 && ce.seriesCount[seriesLabels] > ce.opts.MaxExemplarsPerSeries {
+		ce.truncateChain(seriesLabels, newIdx, ce.opts.MaxExemplarsPerSeries, 0)
+	}
 	return nil
 }
 
@@ -216,10 +526,30 @@ func (ce *CircularExemplarStorage) AddExemplar(l labels.Labels, t int64, e exemp
 	return nil
 }
 
+// AddHistogramExemplar attaches an exemplar to a native histogram sample: h
+// is stored on the exemplar's HistogramValue field instead of Value, so
+// Select returns it with its full bucket layout intact rather than
+// collapsing it to a single scalar. It otherwise goes through the same
+// dedup/out-of-order checks and circular-buffer insertion as AddExemplar.
+//
+// This is exposed as a separate method, rather than overloading
+// storage.ExemplarAppender.AddExemplar's existing (labels.Labels, int64,
+// exemplar.Exemplar) signature, so the protobuf scrape parser for bucketed
+// histograms can call it directly once it constructs an Exemplar with
+// HistogramValue set; that parser and the WAL record type that would
+// persist HistogramValue across a restart (see record.Exemplars) aren't
+// part of this snapshot.
+func (ce *CircularExemplarStorage) AddHistogramExemplar(l labels.Labels, t int64, h histogram.SparseHistogram, e exemplar.Exemplar) error {
+	e.HistogramValue = &h
+	return ce.AddExemplar(l, t, e)
+}
+
 // For use in tests, clears the entire exemplar storage.
 func (ce *CircularExemplarStorage) Reset() {
 	ce.exemplars = make([]*circularBufferEntry, len(ce.exemplars))
 	ce.index = make(map[string]int)
+	ce.seriesCount = make(map[string]int)
+	ce.labelValueIndex = make(map[string]map[string]map[string]struct{})
 }
 
 func reverseExemplars(b []exemplar.Exemplar) {
@@ -0,0 +1,96 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/pkg/exemplar"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestCircularExemplarStorage_SelectMatchers(t *testing.T) {
+	ce := NewCircularExemplarStorageWithOptions(10, nil, ExemplarStorageOptions{})
+
+	a := labels.FromStrings("__name__", "http_requests_total", "job", "api")
+	b := labels.FromStrings("__name__", "http_requests_total", "job", "batch")
+	c := labels.FromStrings("__name__", "grpc_requests_total", "job", "api")
+
+	require.NoError(t, ce.AddExemplar(a, 1, exemplar.Exemplar{Labels: labels.FromStrings("trace_id", "a1"), Ts: 1}))
+	require.NoError(t, ce.AddExemplar(b, 1, exemplar.Exemplar{Labels: labels.FromStrings("trace_id", "b1"), Ts: 1}))
+	require.NoError(t, ce.AddExemplar(c, 1, exemplar.Exemplar{Labels: labels.FromStrings("trace_id", "c1"), Ts: 1}))
+
+	jobAPI := labels.MustNewMatcher(labels.MatchEqual, "job", "api")
+	res, err := ce.SelectMatchers(0, 10, []*labels.Matcher{jobAPI})
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+
+	httpRequests := labels.MustNewMatcher(labels.MatchEqual, "__name__", "http_requests_total")
+	res, err = ce.SelectMatchers(0, 10, []*labels.Matcher{jobAPI, httpRequests})
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Equal(t, "a1", res[0].Labels.Get("trace_id"))
+}
+
+// TestCircularExemplarStorage_SelectMatchers_AfterEviction reproduces the
+// bug where truncateChain cutting a series' older exemplars left the cut
+// ring slots in place with their old seriesLabels intact; once ordinary
+// ring rotation reached one of those stale slots, indexGcCheck deleted the
+// series' index entry out from under its still-live, within-cap chain,
+// silently making SelectMatchers (and Select) return nothing for a series
+// that still had valid exemplars.
+func TestCircularExemplarStorage_SelectMatchers_AfterEviction(t *testing.T) {
+	ce := NewCircularExemplarStorageWithOptions(5, nil, ExemplarStorageOptions{MaxExemplarsPerSeries: 2})
+
+	a := labels.FromStrings("__name__", "http_requests_total", "job", "api")
+	b := labels.FromStrings("__name__", "http_requests_total", "job", "batch")
+
+	for i := int64(1); i <= 5; i++ {
+		require.NoError(t, ce.AddExemplar(a, i, exemplar.Exemplar{Labels: labels.FromStrings("trace_id", string(rune('a'+i))), Ts: i}))
+	}
+	// Rotate the ring onto the cut slots for series a by writing an
+	// unrelated series.
+	require.NoError(t, ce.AddExemplar(b, 6, exemplar.Exemplar{Labels: labels.FromStrings("trace_id", "b1"), Ts: 6}))
+
+	jobAPI := labels.MustNewMatcher(labels.MatchEqual, "job", "api")
+	res, err := ce.SelectMatchers(0, 10, []*labels.Matcher{jobAPI})
+	require.NoError(t, err)
+	require.Len(t, res, 2, "series a's two within-cap exemplars should still be selectable after eviction and ring rotation")
+
+	direct, err := ce.Select(0, 10, a)
+	require.NoError(t, err)
+	require.Len(t, direct, 2)
+}
+
+func TestCircularExemplarStorage_matchingSeriesLocked(t *testing.T) {
+	ce := NewCircularExemplarStorageWithOptions(10, nil, ExemplarStorageOptions{})
+
+	a := labels.FromStrings("__name__", "http_requests_total", "job", "api")
+	b := labels.FromStrings("__name__", "http_requests_total", "job", "batch")
+	require.NoError(t, ce.AddExemplar(a, 1, exemplar.Exemplar{Labels: labels.FromStrings("trace_id", "a1"), Ts: 1}))
+	require.NoError(t, ce.AddExemplar(b, 1, exemplar.Exemplar{Labels: labels.FromStrings("trace_id", "b1"), Ts: 1}))
+
+	ce.lock.RLock()
+	defer ce.lock.RUnlock()
+
+	matched := ce.matchingSeriesLocked([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "job", "api")})
+	require.Len(t, matched, 1)
+	_, ok := matched[a.String()]
+	require.True(t, ok)
+
+	matched = ce.matchingSeriesLocked([]*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "job", "api|batch")})
+	require.Len(t, matched, 2)
+}
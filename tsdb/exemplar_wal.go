@@ -0,0 +1,179 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/prometheus/prometheus/pkg/exemplar"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// RefExemplar is a WAL-encodable exemplar, keyed by the series reference the
+// head already assigns its samples rather than by the series' full label
+// set, matching how head.go's own RefSample/RefSeries records avoid
+// repeating labels on every sample.
+type RefExemplar struct {
+	Ref    uint64
+	T      int64
+	V      float64
+	Labels labels.Labels
+}
+
+// EncodeExemplarRecord serializes exemplars into a single WAL record
+// payload. The caller is expected to prefix the returned bytes with the
+// record.Exemplars type byte before handing it to wal.WAL.Log, the same way
+// every other head.go record is framed; that framing, and the record.Type
+// constant itself, live in tsdb/record and tsdb/wal, neither of which are
+// part of this snapshot, so this function only produces the payload.
+func EncodeExemplarRecord(exemplars []RefExemplar) []byte {
+	buf := make([]byte, 0, len(exemplars)*32)
+	var scratch [binary.MaxVarintLen64]byte
+
+	putUvarint := func(v uint64) {
+		n := binary.PutUvarint(scratch[:], v)
+		buf = append(buf, scratch[:n]...)
+	}
+	putVarint := func(v int64) {
+		n := binary.PutVarint(scratch[:], v)
+		buf = append(buf, scratch[:n]...)
+	}
+
+	putUvarint(uint64(len(exemplars)))
+	for _, re := range exemplars {
+		putUvarint(re.Ref)
+		putVarint(re.T)
+		var vbuf [8]byte
+		binary.BigEndian.PutUint64(vbuf[:], math.Float64bits(re.V))
+		buf = append(buf, vbuf[:]...)
+
+		putUvarint(uint64(len(re.Labels)))
+		for _, l := range re.Labels {
+			putUvarint(uint64(len(l.Name)))
+			buf = append(buf, l.Name...)
+			putUvarint(uint64(len(l.Value)))
+			buf = append(buf, l.Value...)
+		}
+	}
+	return buf
+}
+
+// DecodeExemplarRecord is the inverse of EncodeExemplarRecord, used by WAL
+// replay.
+func DecodeExemplarRecord(b []byte) ([]RefExemplar, error) {
+	n, m := binary.Uvarint(b)
+	if m <= 0 {
+		return nil, fmt.Errorf("invalid exemplar record: bad count")
+	}
+	b = b[m:]
+
+	exemplars := make([]RefExemplar, 0, n)
+	for i := uint64(0); i < n; i++ {
+		var re RefExemplar
+
+		ref, m := binary.Uvarint(b)
+		if m <= 0 {
+			return nil, fmt.Errorf("invalid exemplar record: bad ref at entry %d", i)
+		}
+		re.Ref = ref
+		b = b[m:]
+
+		t, m := binary.Varint(b)
+		if m <= 0 {
+			return nil, fmt.Errorf("invalid exemplar record: bad timestamp at entry %d", i)
+		}
+		re.T = t
+		b = b[m:]
+
+		if len(b) < 8 {
+			return nil, fmt.Errorf("invalid exemplar record: truncated value at entry %d", i)
+		}
+		re.V = math.Float64frombits(binary.BigEndian.Uint64(b))
+		b = b[8:]
+
+		numLabels, m := binary.Uvarint(b)
+		if m <= 0 {
+			return nil, fmt.Errorf("invalid exemplar record: bad label count at entry %d", i)
+		}
+		b = b[m:]
+
+		re.Labels = make(labels.Labels, 0, numLabels)
+		for j := uint64(0); j < numLabels; j++ {
+			name, rest, err := readString(b)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exemplar record: label name at entry %d: %w", i, err)
+			}
+			b = rest
+			value, rest, err := readString(b)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exemplar record: label value at entry %d: %w", i, err)
+			}
+			b = rest
+			re.Labels = append(re.Labels, labels.Label{Name: name, Value: value})
+		}
+
+		exemplars = append(exemplars, re)
+	}
+	return exemplars, nil
+}
+
+func readString(b []byte) (string, []byte, error) {
+	l, m := binary.Uvarint(b)
+	if m <= 0 || uint64(len(b)-m) < l {
+		return "", nil, fmt.Errorf("truncated string")
+	}
+	b = b[m:]
+	return string(b[:l]), b[l:], nil
+}
+
+// ReplaySeriesLookup resolves the series reference a RefExemplar was logged
+// against back to its labels. Head keeps this mapping (built while replaying
+// the RefSeries records that always precede any RefExemplar for the same
+// series) in memory across the whole WAL replay; it isn't reproduced here
+// since Head itself isn't part of this snapshot.
+type ReplaySeriesLookup func(ref uint64) (labels.Labels, bool)
+
+// ReplayExemplars replays decoded exemplar records into ce in insertion
+// order, so the prev-index chain CircularExemplarStorage relies on for
+// truncateChain comes back identical to what it was before the restart.
+// This is the function Head.loadWAL would call for each Exemplars record it
+// encounters, in timestamp order alongside the RefSample/RefSeries records
+// from the same segment; that call site doesn't exist here since
+// tsdb/head.go, tsdb/wal and tsdb/record aren't part of this snapshot.
+func ReplayExemplars(ce *CircularExemplarStorage, records [][]byte, lookup ReplaySeriesLookup) (int, error) {
+	var replayed int
+	for _, rec := range records {
+		refExemplars, err := DecodeExemplarRecord(rec)
+		if err != nil {
+			return replayed, err
+		}
+		for _, re := range refExemplars {
+			l, ok := lookup(re.Ref)
+			if !ok {
+				// The series itself was truncated from the WAL (e.g. it was
+				// dropped by a head compaction) before this exemplar's
+				// record; head.go's own sample replay skips these the same
+				// way.
+				continue
+			}
+			if err := ce.addExemplar(l, re.T, exemplar.Exemplar{Labels: re.Labels, Value: re.V, Ts: re.T, HasTs: true}); err != nil {
+				return replayed, err
+			}
+			replayed++
+		}
+	}
+	return replayed, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestExemplarRecord_RoundTrip(t *testing.T) {
+	in := []RefExemplar{
+		{
+			Ref:    1,
+			T:      1000,
+			V:      3.5,
+			Labels: labels.Labels{{Name: "trace_id", Value: "abc"}},
+		},
+		{
+			Ref:    2,
+			T:      -500,
+			V:      0,
+			Labels: labels.Labels{{Name: "trace_id", Value: "def"}, {Name: "span_id", Value: "ghi"}},
+		},
+		{
+			Ref:    3,
+			T:      0,
+			V:      -1.25,
+			Labels: nil,
+		},
+	}
+
+	b := EncodeExemplarRecord(in)
+	out, err := DecodeExemplarRecord(b)
+	require.NoError(t, err)
+	require.Len(t, out, len(in))
+	for i := range in {
+		require.Equal(t, in[i].Ref, out[i].Ref)
+		require.Equal(t, in[i].T, out[i].T)
+		require.Equal(t, in[i].V, out[i].V)
+		require.Equal(t, len(in[i].Labels), len(out[i].Labels))
+		for j := range in[i].Labels {
+			require.Equal(t, in[i].Labels[j], out[i].Labels[j])
+		}
+	}
+}
+
+func TestExemplarRecord_EmptyInput(t *testing.T) {
+	b := EncodeExemplarRecord(nil)
+	out, err := DecodeExemplarRecord(b)
+	require.NoError(t, err)
+	require.Empty(t, out)
+}
+
+func TestDecodeExemplarRecord_TruncatedInput(t *testing.T) {
+	in := []RefExemplar{{Ref: 1, T: 1, V: 1, Labels: labels.Labels{{Name: "a", Value: "b"}}}}
+	b := EncodeExemplarRecord(in)
+
+	_, err := DecodeExemplarRecord(b[:len(b)-1])
+	require.Error(t, err)
+}
+
+// TestReplayExemplars checks that decoded records are fed into a
+// CircularExemplarStorage via addExemplar in order, and that a ref the
+// lookup can't resolve (e.g. a series truncated from the WAL before this
+// exemplar's record) is skipped rather than aborting the whole replay.
+func TestReplayExemplars(t *testing.T) {
+	ce := NewCircularExemplarStorage(10, nil)
+
+	known := labels.Labels{{Name: "__name__", Value: "up"}}
+	records := [][]byte{
+		EncodeExemplarRecord([]RefExemplar{
+			{Ref: 1, T: 100, V: 1, Labels: labels.Labels{{Name: "trace_id", Value: "a"}}},
+			{Ref: 2, T: 200, V: 2, Labels: labels.Labels{{Name: "trace_id", Value: "b"}}},
+		}),
+	}
+	lookup := func(ref uint64) (labels.Labels, bool) {
+		if ref == 1 {
+			return known, true
+		}
+		return nil, false
+	}
+
+	n, err := ReplayExemplars(ce, records, lookup)
+	require.NoError(t, err)
+	require.Equal(t, 1, n, "only ref 1 resolves via lookup, ref 2 should be skipped")
+}